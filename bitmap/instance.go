@@ -0,0 +1,38 @@
+package bitmap
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	instanceLock = sync.RWMutex{}
+	instances    = make(map[string]API)
+)
+
+// RegisterInstance 注册一个命名bitmap实例，供监控、管理接口按名字访问，同名实例会被覆盖。
+// 注意：监控采集会在其他协程调用Len，实例需要支持并发访问
+func RegisterInstance(name string, api API) {
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+	instances[name] = api
+}
+
+// GetInstance 根据名字返回命名bitmap实例，不存在返回nil
+func GetInstance(name string) API {
+	instanceLock.RLock()
+	defer instanceLock.RUnlock()
+	return instances[name]
+}
+
+// InstanceNames 返回所有命名bitmap实例的名字，按字典序排列
+func InstanceNames() []string {
+	instanceLock.RLock()
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	instanceLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
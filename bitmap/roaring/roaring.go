@@ -2,8 +2,19 @@ package roaring
 
 import (
 	"context"
+	"sync"
+	"time"
+
+	"git.code.oa.com/trpc-go/trpc-database/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracerName OpenTelemetry tracer名，未设置全局TracerProvider时不产生span
+const tracerName = "git.code.oa.com/video_pay_root/pay-go-comm/tcache/bitmap/roaring"
+
 // RB64API 64位roaring对外接口
 type RB64API interface {
 	// Add 将整数x添加到位图
@@ -35,3 +46,39 @@ type RB32API interface {
 	// Clear 清空位图
 	Clear(ctx context.Context) error
 }
+
+// OpObserver redis bitmap操作观察者，name为bitmap名，op为操作名，cost为耗时，err为操作结果
+type OpObserver func(name string, op string, cost time.Duration, err error)
+
+var (
+	observerLock = sync.RWMutex{}
+	observers    []OpObserver
+)
+
+// AddOpObserver 注册redis bitmap操作观察者，用于统计耗时、上报监控等，每次操作都会同步回调
+func AddOpObserver(observer OpObserver) {
+	observerLock.Lock()
+	defer observerLock.Unlock()
+	observers = append(observers, observer)
+}
+
+// doScript 执行lua脚本中的op操作，每次操作产生一个span，并通知所有观察者
+func doScript(ctx context.Context, script *redis.Script, proxy redis.Client, name, key string, op operation,
+	args ...interface{}) (interface{}, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "roaring."+string(op), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "redis"), attribute.String("tcache.bitmap", name)))
+	defer span.End()
+	start := time.Now()
+	reply, err := script.Do(ctx, proxy, append([]interface{}{key, op}, args...)...)
+	cost := time.Since(start)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	observerLock.RLock()
+	for _, observer := range observers {
+		observer(name, string(op), cost, err)
+	}
+	observerLock.RUnlock()
+	return reply, err
+}
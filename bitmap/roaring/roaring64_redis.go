@@ -46,37 +46,42 @@ func NewRoaring64(name string, proxy redis.Client) RB64API {
 
 // Add 将整数x添加到位图
 func (r *roaring64Impl) Add(ctx context.Context, x uint64) error {
-	_, err := r.script.Do(ctx, r.proxy, r.getKeyName(), Add, x)
+	_, err := r.do(ctx, Add, x)
 	return err
 }
 
 // Remove 将整数x从位图移除
 func (r *roaring64Impl) Remove(ctx context.Context, x uint64) error {
-	_, err := r.script.Do(ctx, r.proxy, r.getKeyName(), Remove, x)
+	_, err := r.do(ctx, Remove, x)
 	return err
 }
 
 // Contains 整数x是否包含在位图
 func (r *roaring64Impl) Contains(ctx context.Context, x uint64) (bool, error) {
-	return redis.Bool(r.script.Do(ctx, r.proxy, r.getKeyName(), Contains, x))
+	return redis.Bool(r.do(ctx, Contains, x))
 }
 
 // IsEmpty 判断位图是否为空
 func (r *roaring64Impl) IsEmpty(ctx context.Context) (bool, error) {
-	return redis.Bool(r.script.Do(ctx, r.proxy, r.getKeyName(), IsEmpty))
+	return redis.Bool(r.do(ctx, IsEmpty))
 }
 
 // Len 返回位图中存储的元素个数
 func (r *roaring64Impl) Len(ctx context.Context) (uint64, error) {
-	return redis.Uint64(r.script.Do(ctx, r.proxy, r.getKeyName(), Len))
+	return redis.Uint64(r.do(ctx, Len))
 }
 
 // Clear 清空位图
 func (r *roaring64Impl) Clear(ctx context.Context) error {
-	_, err := r.script.Do(ctx, r.proxy, r.getKeyName(), Clear)
+	_, err := r.do(ctx, Clear)
 	return err
 }
 
+// do 执行lua脚本中的op操作
+func (r *roaring64Impl) do(ctx context.Context, op operation, args ...interface{}) (interface{}, error) {
+	return doScript(ctx, r.script, r.proxy, r.name, r.getKeyName(), op, args...)
+}
+
 func (r *roaring64Impl) getKeyName() string {
 	return fmt.Sprintf("{%s}", r.name)
 }
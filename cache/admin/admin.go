@@ -0,0 +1,269 @@
+// Package admin 提供查看和管理命名cache实例、命名bitmap实例的http接口，用于排查问题：
+//
+//	h := admin.NewHandler(admin.WithAuthorizer(func(r *http.Request) error {
+//	    if r.Header.Get("X-Admin-Token") != token {
+//	        return errors.New("invalid token")
+//	    }
+//	    return nil
+//	}))
+//	http.Handle("/debug/tcache/", http.StripPrefix("/debug/tcache", h))
+//
+// 接口列表：
+//
+//	GET    /instances                    所有命名cache实例的引擎、配置和统计数据
+//	GET    /instances/{name}             单个实例的引擎、配置和统计数据
+//	GET    /instances/{name}/keys/{key}  查询key，返回原始数据(base64)和解码后的json
+//	DELETE /instances/{name}/keys/{key}  删除key，需要鉴权
+//	POST   /instances/{name}/clear       清空实例，需要鉴权
+//	GET    /instances/{name}/hotkeys?n=  热key，需要通过WithHotKeys注册HotKeyTracker
+//	GET    /bitmaps                      所有命名bitmap实例的元素个数
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/bitmap"
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/cache"
+)
+
+const defaultHotKeys = 10
+
+// ErrNoAuthorizer 没有设置鉴权函数时，修改类接口一律拒绝
+var ErrNoAuthorizer = errors.New("no authorizer")
+
+// Authorizer 修改类接口(删除key、清空实例)的鉴权函数，返回非nil拒绝请求
+type Authorizer func(r *http.Request) error
+
+// Option 参数选项
+type Option func(*Handler)
+
+// WithAuthorizer 设置修改类接口的鉴权函数，不设置时修改类接口返回403
+func WithAuthorizer(auth Authorizer) Option {
+	return func(h *Handler) {
+		h.auth = auth
+	}
+}
+
+// WithHotKeys 为实例name注册热key统计，用于hotkeys接口
+func WithHotKeys(name string, tracker *cache.HotKeyTracker) Option {
+	return func(h *Handler) {
+		h.hotKeys[name] = tracker
+	}
+}
+
+// Handler 管理接口http.Handler
+type Handler struct {
+	auth    Authorizer
+	hotKeys map[string]*cache.HotKeyTracker
+}
+
+// InstanceInfo 命名cache实例信息
+type InstanceInfo struct {
+	Name         string                `json:"name"`
+	Engine       string                `json:"engine,omitempty"`
+	Config       *cache.InstanceConfig `json:"config,omitempty"` // 通过RegisterInstance注册的实例没有配置
+	Capabilities cache.Capability      `json:"capabilities"`
+	Stats        cache.Stats           `json:"stats"`
+}
+
+// KeyInfo key查询结果
+type KeyInfo struct {
+	Key         string          `json:"key"`
+	Raw         []byte          `json:"raw,omitempty"`          // 原始数据，引擎未实现RawGetter时为空
+	Value       json.RawMessage `json:"value,omitempty"`        // 解码后的value
+	DecodeError string          `json:"decode_error,omitempty"` // 解码失败的原因
+}
+
+// BitmapInfo 命名bitmap实例信息
+type BitmapInfo struct {
+	Name        string `json:"name"`
+	Cardinality uint64 `json:"cardinality"`
+}
+
+// NewHandler 构造管理接口
+func NewHandler(opts ...Option) *Handler {
+	h := &Handler{hotKeys: make(map[string]*cache.HotKeyTracker)}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// ServeHTTP 实现http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "instances":
+		h.allowMethod(w, r, http.MethodGet, h.listInstances)
+	case path == "bitmaps":
+		h.allowMethod(w, r, http.MethodGet, h.listBitmaps)
+	case strings.HasPrefix(path, "instances/"):
+		h.serveInstance(w, r, strings.TrimPrefix(path, "instances/"))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serveInstance 处理/instances/{name}下的接口，key可以包含/
+func (h *Handler) serveInstance(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.SplitN(path, "/", 3)
+	name := parts[0]
+	api := cache.GetInstance(name)
+	if api == nil {
+		writeError(w, http.StatusNotFound, "no such instance "+name)
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		h.allowMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, instanceInfo(name, api))
+		})
+	case len(parts) == 2 && parts[1] == "clear":
+		h.allowMethod(w, r, http.MethodPost, h.authorized(func(w http.ResponseWriter, r *http.Request) {
+			reply(w, api.Clear())
+		}))
+	case len(parts) == 2 && parts[1] == "hotkeys":
+		h.allowMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			h.hotKeysOf(w, r, name)
+		})
+	case len(parts) == 3 && parts[1] == "keys" && parts[2] != "":
+		key := parts[2]
+		switch r.Method {
+		case http.MethodGet:
+			getKey(w, api, key)
+		case http.MethodDelete:
+			h.authorized(func(w http.ResponseWriter, r *http.Request) {
+				reply(w, api.Delete(key))
+			})(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) listInstances(w http.ResponseWriter, r *http.Request) {
+	infos := make([]*InstanceInfo, 0)
+	for _, name := range cache.InstanceNames() {
+		if api := cache.GetInstance(name); api != nil {
+			infos = append(infos, instanceInfo(name, api))
+		}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *Handler) listBitmaps(w http.ResponseWriter, r *http.Request) {
+	infos := make([]*BitmapInfo, 0)
+	for _, name := range bitmap.InstanceNames() {
+		if b := bitmap.GetInstance(name); b != nil {
+			infos = append(infos, &BitmapInfo{Name: name, Cardinality: b.Len()})
+		}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *Handler) hotKeysOf(w http.ResponseWriter, r *http.Request, name string) {
+	tracker := h.hotKeys[name]
+	if tracker == nil {
+		writeError(w, http.StatusNotImplemented, "hot key tracking not enabled for "+name)
+		return
+	}
+	n := defaultHotKeys
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid n")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, tracker.HotKeys(n))
+}
+
+// getKey 查询key，解码时调用Get，会计入实例的统计数据
+func getKey(w http.ResponseWriter, api cache.API, key string) {
+	info := &KeyInfo{Key: key}
+	if raw, ok := cache.Unwrap(api).(cache.RawGetter); ok {
+		data, err := raw.GetRaw(key)
+		if err != nil {
+			reply(w, err)
+			return
+		}
+		info.Raw = data
+	}
+	var value interface{}
+	if err := api.Get(key, &value); err != nil {
+		if errors.Is(err, cache.ErrNotFound) {
+			reply(w, err)
+			return
+		}
+		info.DecodeError = err.Error()
+	} else if data, err := json.Marshal(value); err != nil {
+		info.DecodeError = err.Error()
+	} else {
+		info.Value = data
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// allowMethod 只允许method方法调用next
+func (h *Handler) allowMethod(w http.ResponseWriter, r *http.Request, method string, next http.HandlerFunc) {
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	next(w, r)
+}
+
+// authorized 鉴权通过后调用next
+func (h *Handler) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := ErrNoAuthorizer
+		if h.auth != nil {
+			err = h.auth(r)
+		}
+		if err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+func instanceInfo(name string, api cache.API) *InstanceInfo {
+	info := &InstanceInfo{Name: name, Engine: cache.GetInstanceEngine(api),
+		Capabilities: cache.GetInstanceCapabilities(api), Stats: api.GetStats()}
+	if cfg := cache.GetInstanceConfig(name); cfg != nil {
+		info.Config = cfg
+		if info.Engine == "" {
+			info.Engine = cfg.Engine
+		}
+	}
+	return info
+}
+
+// reply 根据操作结果返回，成功返回{}
+func reply(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, struct{}{})
+	case errors.Is(err, cache.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
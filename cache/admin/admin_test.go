@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/bitmap"
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+const token = "secret"
+
+func newServer(t *testing.T) *httptest.Server {
+	err := cache.SetupInstances([]*cache.InstanceConfig{
+		{Name: "admin_test", Engine: cache.EngineFreeCache, MaxSizeInMB: 1},
+	})
+	assert.Nil(t, err)
+	tracker := cache.NewHotKeyTracker(cache.HotKeyConfig{})
+	local, err := cache.New(cache.EngineLocalCache, 1)
+	assert.Nil(t, err)
+	cache.RegisterInstance("admin_test_local", cache.Chain(local, tracker.Middleware()))
+
+	b, err := bitmap.New(bitmap.EngineBitset)
+	assert.Nil(t, err)
+	b.Add(1)
+	bitmap.RegisterInstance("admin_test", b)
+
+	h := NewHandler(WithHotKeys("admin_test_local", tracker), WithAuthorizer(func(r *http.Request) error {
+		if r.Header.Get("X-Token") != token {
+			return errors.New("invalid token")
+		}
+		return nil
+	}))
+	return httptest.NewServer(http.StripPrefix("/debug/tcache", h))
+}
+
+func do(t *testing.T, method, url string, auth bool, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	assert.Nil(t, err)
+	if auth {
+		req.Header.Set("X-Token", token)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+	if v != nil {
+		assert.Nil(t, json.NewDecoder(rsp.Body).Decode(v))
+	}
+	return rsp.StatusCode
+}
+
+func TestInstances(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	prefix := srv.URL + "/debug/tcache"
+	assert.Nil(t, cache.GetInstance("admin_test").Set("user/1", map[string]int{"age": 18}))
+
+	var infos []*InstanceInfo
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, prefix+"/instances", false, &infos))
+	names := map[string]*InstanceInfo{}
+	for _, info := range infos {
+		names[info.Name] = info
+	}
+	assert.Equal(t, cache.EngineFreeCache, names["admin_test"].Engine)
+	assert.Equal(t, 1, names["admin_test"].Config.MaxSizeInMB)
+	assert.Equal(t, int64(1), names["admin_test"].Stats.EntryCount)
+	assert.Nil(t, names["admin_test_local"].Config)
+	assert.Equal(t, cache.EngineLocalCache, names["admin_test_local"].Engine)
+
+	var info InstanceInfo
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, prefix+"/instances/admin_test", false, &info))
+	assert.Equal(t, cache.CapPerKeyTTL|cache.CapResize, info.Capabilities)
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, prefix+"/instances/xxx", false, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, do(t, http.MethodPost, prefix+"/instances", false, nil))
+
+	// 查询key，key可以包含/
+	var key KeyInfo
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, prefix+"/instances/admin_test/keys/user/1", false, &key))
+	assert.Equal(t, `{"age":18}`, string(key.Raw))
+	assert.JSONEq(t, `{"age":18}`, string(key.Value))
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, prefix+"/instances/admin_test/keys/user/2", false, nil))
+
+	// 修改类接口需要鉴权
+	url := prefix + "/instances/admin_test/keys/user/1"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodDelete, url, false, nil))
+	assert.Equal(t, http.StatusOK, do(t, http.MethodDelete, url, true, nil))
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, url, false, nil))
+
+	assert.Nil(t, cache.GetInstance("admin_test").Set("a", 1))
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, prefix+"/instances/admin_test/clear", false, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, do(t, http.MethodGet, prefix+"/instances/admin_test/clear", true, nil))
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, prefix+"/instances/admin_test/clear", true, nil))
+	assert.Equal(t, int64(0), cache.GetInstance("admin_test").GetStats().EntryCount)
+
+	// 未设置鉴权函数时一律拒绝
+	noAuth := httptest.NewServer(NewHandler())
+	defer noAuth.Close()
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, noAuth.URL+"/instances/admin_test/clear", true, nil))
+}
+
+func TestLocalCacheKeyAndHotKeys(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	prefix := srv.URL + "/debug/tcache/instances/admin_test_local"
+	local := cache.GetInstance("admin_test_local")
+	assert.Nil(t, local.Set("a", []string{"x"}))
+	var value []string
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, local.Get("a", &value))
+	}
+	assert.Equal(t, cache.ErrNotFound, local.Get("b", &value))
+
+	var key KeyInfo
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, prefix+"/keys/a", false, &key))
+	assert.Nil(t, key.Raw)
+	assert.JSONEq(t, `["x"]`, string(key.Value))
+
+	var hot []cache.HotKey
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, prefix+"/hotkeys?n=1", false, &hot))
+	assert.Equal(t, []cache.HotKey{{Key: "a", Count: 4}}, hot)
+	assert.Equal(t, http.StatusBadRequest, do(t, http.MethodGet, prefix+"/hotkeys?n=x", false, nil))
+	assert.Equal(t, http.StatusNotImplemented,
+		do(t, http.MethodGet, srv.URL+"/debug/tcache/instances/admin_test/hotkeys", false, nil))
+
+	var bitmaps []*BitmapInfo
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, srv.URL+"/debug/tcache/bitmaps", false, &bitmaps))
+	assert.Contains(t, bitmaps, &BitmapInfo{Name: "admin_test", Cardinality: 1})
+}
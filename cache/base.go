@@ -0,0 +1,413 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"git.code.oa.com/trpc-go/trpc-go/log"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// base 各引擎实现共用的实例状态
+type base struct {
+	cfg     *Config
+	closed  int32 // 实例是否已关闭，原子读写
+	stats   counters
+	group   singleflight.Group // 防止同一个key并发加载
+	breaker *breaker           // 自动加载熔断器，未开启时为nil
+	loadSem chan struct{}      // 限制同时执行的LoadFunc数量，未限制时为nil
+	leases  *leases            // 自动加载回填的租约
+}
+
+// 随机数来源，返回[0,1)，测试时可替换
+var (
+	jitterRand = rand.Float64 // 过期时间浮动
+	xfetchRand = rand.Float64 // 提前刷新
+)
+
+func newBase(cfg *Config) *base {
+	b := &base{cfg: cfg, leases: newLeases()}
+	if cfg.BreakerFailures > 0 {
+		b.breaker = newBreaker(cfg.BreakerFailures, cfg.BreakerCoolDown)
+	}
+	if cfg.MaxConcurrentLoads > 0 {
+		b.loadSem = make(chan struct{}, cfg.MaxConcurrentLoads)
+	}
+	return b
+}
+
+// fillStats 填充各引擎共用的统计数据，引擎特有的字段由引擎自己填充
+func (b *base) fillStats(stats *Stats) {
+	b.stats.fill(stats)
+	if b.breaker != nil {
+		stats.BreakerState = b.breaker.currentState()
+	}
+}
+
+// emit 产生变更事件，未设置EventHook时忽略
+func (b *base) emit(typ, key string, ttl int64) {
+	if b.cfg.EventHook != nil {
+		b.cfg.EventHook(Event{Type: typ, Key: key, TTL: ttl})
+	}
+}
+
+// checkClosed 实例已关闭时返回ErrClosed
+func (b *base) checkClosed() error {
+	if atomic.LoadInt32(&b.closed) == 1 {
+		return ErrClosed
+	}
+	return nil
+}
+
+// markClosed 标记实例已关闭，重复关闭返回ErrClosed
+func (b *base) markClosed() error {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// jitter 按TTLJitter随机调整过期时间，ttl<=0代表不过期，不调整；调整后至少为1秒
+func (b *base) jitter(ttl int64) int64 {
+	if b.cfg.TTLJitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	delta := int64(float64(ttl) * b.cfg.TTLJitter * (2*jitterRand() - 1))
+	if ttl += delta; ttl < 1 {
+		ttl = 1
+	}
+	return ttl
+}
+
+// Engine 返回实例的引擎名
+func (b *base) Engine() string {
+	return b.cfg.Engine
+}
+
+// GetWindowStats 获取最近window时间内的统计数据，最长MaxStatsWindow
+func (b *base) GetWindowStats(window time.Duration) WindowStats {
+	return b.stats.window.stats(window)
+}
+
+// LoadDurationHistogram 返回自动加载耗时直方图
+func (b *base) LoadDurationHistogram() HistogramSnapshot {
+	return b.stats.loadDuration.snapshot()
+}
+
+// getWithLoad key如果不存在，实时加载。ctx会传递给LoadFunc，开启tracing时LoadFunc在子span中执行。
+// 开启提前刷新时，命中的key也可能按XFetch算法提前加载，加载失败仍返回缓存的数据；
+// 开启StaleTTL时，加载失败(含熔断)返回还在保留期内的过期数据
+func (b *base) getWithLoad(ctx context.Context, cache API, key string, value interface{}, load LoadFunc) error {
+	ctx, span := tracer().Start(ctx, "cache.GetWithLoad", trace.WithAttributes(attrEngine.String(b.cfg.Engine)))
+	defer span.End()
+	meta, err := b.get(cache, key, value)
+	hit, stale := err == nil, err == errStale
+	span.SetAttributes(attrHit.Bool(hit))
+	if hooks := loadHooksFrom(ctx); !hit && hooks != nil && hooks.miss != nil {
+		hooks.miss()
+	}
+	if hit {
+		if !b.refreshEarly(meta) {
+			return nil
+		}
+		b.stats.earlyRefresh()
+		span.SetAttributes(attrEarlyRefresh.Bool(true))
+	}
+	// 不存在，则重新获取；使用singleflight防止并发获取。加载在独立的goroutine中执行，
+	// 不受任何调用方ctx取消的影响，每个调用方在自己的ctx取消时直接返回
+	var leader int32
+	ch := b.group.DoChan(key, func() (interface{}, error) {
+		atomic.StoreInt32(&leader, 1)
+		return b.load(detach(ctx), cache, key, value, load)
+	})
+	select {
+	case res := <-ch:
+		err = res.Err
+		if err == nil {
+			err = b.assign(cache, key, value, res.Val)
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	span.SetAttributes(attrDeduped.Bool(atomic.LoadInt32(&leader) == 0))
+	if err == nil {
+		return nil
+	}
+	span.RecordError(err)
+	// 提前刷新失败时value还是缓存的数据；过期数据未解析，重新读取
+	if hit {
+		return nil
+	}
+	if stale && b.getStale(cache, key, value) == nil {
+		b.stats.staleHit()
+		span.SetAttributes(attrStale.Bool(true))
+		return nil
+	}
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
+
+// assign 将共享的加载结果复制到本次调用的value，类型不一致时从cache重新读取
+func (b *base) assign(cache API, key string, value, loaded interface{}) error {
+	if assignValue(value, loaded) {
+		return nil
+	}
+	return b.getStale(cache, key, value)
+}
+
+// assignValue 将src赋值给dst指向的对象，src可以是同类型的值或指针，类型不匹配返回false
+func assignValue(dst, src interface{}) bool {
+	d, v := reflect.ValueOf(dst), reflect.ValueOf(src)
+	if d.Kind() != reflect.Ptr || d.IsNil() || !v.IsValid() {
+		return false
+	}
+	if v.Type() == d.Type() {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	if !v.Type().AssignableTo(d.Elem().Type()) {
+		return false
+	}
+	d.Elem().Set(v)
+	return true
+}
+
+// get 读取key，引擎支持时同时返回元数据
+func (b *base) get(cache API, key string, value interface{}) (entryMeta, error) {
+	if store, ok := cache.(entryStore); ok {
+		return store.getEntry(key, value, false)
+	}
+	return entryMeta{}, cache.Get(key, value)
+}
+
+// decodeError 处理value解析失败。读取目标不是非空指针，或保存的数据可以解析但与读取目标类型不匹配时，
+// 是调用方的错误，entry保留，返回包装了ErrCannotSet的错误；数据本身无法解析(解析到interface{}也失败)时视为损坏，
+// 调用remove删除entry并返回*DecodeError。读取目标为*interface{}(如管理接口)时不删除。stale读取不计入命中统计
+func (b *base) decodeError(key string, value interface{}, data []byte, stale bool, err error, remove func()) error {
+	if _, generic := value.(*interface{}); !generic {
+		var probe interface{}
+		if !isSettable(value) || b.cfg.Serializer.Unmarshal(data, &probe) == nil {
+			return b.mismatch(key, stale, err)
+		}
+		remove()
+	}
+	b.stats.serializeError()
+	b.stats.decodeError()
+	if !stale {
+		b.stats.miss()
+	}
+	return &DecodeError{Engine: b.cfg.Engine, Key: key, Err: err}
+}
+
+// mismatch 读取目标与保存的value类型不匹配，entry保留，计入SerializeErrors和未命中
+func (b *base) mismatch(key string, stale bool, err error) error {
+	b.stats.serializeError()
+	if !stale {
+		b.stats.miss()
+	}
+	if errors.Is(err, ErrCannotSet) {
+		return err
+	}
+	return fmt.Errorf("%w: key %q: %v", ErrCannotSet, key, err)
+}
+
+// isSettable value是否为可以赋值的非空指针
+func isSettable(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	return v.Kind() == reflect.Ptr && !v.IsNil()
+}
+
+// getStale 读取key，包括已过期但还在StaleTTL内的数据，不计入统计数据
+func (b *base) getStale(cache API, key string, value interface{}) error {
+	if store, ok := cache.(entryStore); ok {
+		_, err := store.getEntry(key, value, true)
+		return err
+	}
+	return cache.Get(key, value)
+}
+
+// refreshEarly XFetch算法：距离过期时间越近、上次加载耗时越长，越可能提前刷新，
+// 即 now - delta * beta * ln(rand) >= expire
+func (b *base) refreshEarly(meta entryMeta) bool {
+	if b.cfg.EarlyRefreshBeta <= 0 || meta.expire == 0 || meta.delta <= 0 {
+		return false
+	}
+	if b.breaker != nil && b.breaker.isOpen() {
+		return false
+	}
+	gap := -meta.delta.Seconds() * b.cfg.EarlyRefreshBeta * math.Log(xfetchRand())
+	return float64(time.Now().UnixNano())/float64(time.Second)+gap >= float64(meta.expire)
+}
+
+// load 调用LoadFunc加载key并通过租约回填cache，同时保存加载耗时。熔断中返回ErrCircuitOpen。
+// LoadFunc加载到与value同类型的新对象中，返回该对象，由各调用方复制。
+// 加载期间key被Set/Delete/Clear时租约失效，不回填，但仍返回加载结果；回填失败计入Stats.FillErrors。
+// LoadFunc panic时按加载失败处理，返回ErrLoadPanic
+func (b *base) load(ctx context.Context, cache API, key string, value interface{}, load LoadFunc) (interface{}, error) {
+	if b.cfg.LoadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.LoadTimeout)
+		defer cancel()
+	}
+	if b.loadSem != nil {
+		select {
+		case b.loadSem <- struct{}{}:
+			defer func() { <-b.loadSem }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if b.breaker != nil && !b.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+	ctx, span := tracer().Start(ctx, "cache.LoadFunc")
+	defer span.End()
+	// 回调只属于本次加载，不传给LoadFunc，避免LoadFunc中调用其他实例时误用
+	hooks := loadHooksFrom(ctx)
+	if hooks != nil {
+		ctx = context.WithValue(ctx, loadHooksKey{}, nil)
+	}
+	token := b.leases.acquire(key)
+	value = newValue(value)
+	start := time.Now()
+	ttl, err := callLoad(ctx, key, value, load)
+	cost := time.Since(start)
+	b.stats.load(cost)
+	if b.breaker != nil && b.breaker.done(err) {
+		b.stats.breakerOpen()
+	}
+	if err != nil {
+		b.leases.invalidate(key)
+		b.stats.loadError()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	fillTTL := ttl
+	if fillTTL <= 0 {
+		fillTTL = b.cfg.DefaultTTL
+	}
+	fillTTL = b.jitter(fillTTL)
+	writer := cache.(entryWriter)
+	filled, err := b.leases.fill(key, token, func() error {
+		return writer.setEntry(key, value, fillTTL, cost)
+	}, func() { writer.remove(key) })
+	switch {
+	case !filled:
+		b.stats.leaseDrop()
+		span.SetAttributes(attrLeaseDropped.Bool(true))
+	case err != nil:
+		// 回填失败不影响本次返回的加载结果，计入统计并记录在span中
+		b.stats.fillError()
+		span.SetAttributes(attrFillError.String(err.Error()))
+	default:
+		// 事件中为实际写入的过期时间，不支持单独指定过期时间的引擎按DefaultTTL过期，不过期时为0
+		r, ok := cache.(CapabilityReporter)
+		switch {
+		case ok && !r.Capabilities().Has(CapPerKeyTTL):
+			fillTTL = b.cfg.DefaultTTL
+		case ttl <= 0 && b.cfg.DefaultTTL == tenYearsInSecond:
+			fillTTL = 0
+		}
+		b.emit(EventSet, key, fillTTL)
+	}
+	if filled && hooks != nil && hooks.fill != nil {
+		hooks.fill(value, ttl, err)
+	}
+	return value, nil
+}
+
+// callLoad 调用LoadFunc，panic时恢复并返回ErrLoadPanic。加载在singleflight的协程中执行，
+// 不恢复时panic无法被调用方的recover捕获，会导致进程退出
+func callLoad(ctx context.Context, key string, value interface{}, load LoadFunc) (ttl int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("cache load panic, key %s: %v\n%s", key, r, debug.Stack())
+			err = fmt.Errorf("%w: %v", ErrLoadPanic, r)
+		}
+	}()
+	return load(ctx, key, value)
+}
+
+// loadHooks 包装层(如WithOverflow、Partitioned)通过ctx传给引擎GetWithLoad的回调，用于得知未命中和回填结果
+type loadHooks struct {
+	// miss 未命中或命中过期数据，包括合并到其他协程的加载，在调用方协程中执行
+	miss func()
+	// fill 租约有效时的回填结果，err为空代表回填成功，返回值传给外层包装的fill。
+	// 在执行LoadFunc的协程中、LoadFunc返回之后调用，singleflight合并的调用只有执行加载的ctx生效
+	fill func(value interface{}, ttl int64, err error) error
+}
+
+// loadHooksKey ctx中保存*loadHooks的key
+type loadHooksKey struct{}
+
+// withLoadHooks 返回携带回调的ctx，ctx中已有外层包装的回调时，先执行本层再执行外层
+func withLoadHooks(ctx context.Context, hooks loadHooks) context.Context {
+	if outer := loadHooksFrom(ctx); outer != nil {
+		inner := hooks
+		hooks.miss = func() {
+			if inner.miss != nil {
+				inner.miss()
+			}
+			if outer.miss != nil {
+				outer.miss()
+			}
+		}
+		hooks.fill = func(value interface{}, ttl int64, err error) error {
+			if inner.fill != nil {
+				err = inner.fill(value, ttl, err)
+			}
+			if outer.fill != nil {
+				err = outer.fill(value, ttl, err)
+			}
+			return err
+		}
+	}
+	return context.WithValue(ctx, loadHooksKey{}, &hooks)
+}
+
+func loadHooksFrom(ctx context.Context) *loadHooks {
+	hooks, _ := ctx.Value(loadHooksKey{}).(*loadHooks)
+	return hooks
+}
+
+// newValue 构造与value同类型的新对象，value不是非空指针时原样返回
+func newValue(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return value
+	}
+	return reflect.New(v.Type().Elem()).Interface()
+}
+
+// detachedContext 保留父ctx的值(如trace span)，但不继承其取消和超时
+type detachedContext struct {
+	parent context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+// Deadline 实现context.Context，没有截止时间
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+// Done 实现context.Context，永不取消
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+// Err 实现context.Context
+func (detachedContext) Err() error { return nil }
+
+// Value 实现context.Context，从父ctx取值
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -2,21 +2,29 @@ package cache
 
 import (
 	"context"
-	"sync/atomic"
+	"fmt"
+	"math"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
 )
 
-const defaultEviction = 7 * 24 * time.Hour // 7天
+const (
+	defaultEviction = 7 * 24 * time.Hour // 7天
+	// bigcacheEntryOverhead bigcache每个entry的额外开销：时间戳8字节 + hash 8字节 + key长度2字节 + 队列长度头最多5字节 + 队列起始的1字节
+	bigcacheEntryOverhead = 24
+	// bigcacheEventBuffer 过期和淘汰事件的分发缓冲区大小，满时丢弃并计入Stats.EventDrops
+	bigcacheEventBuffer = 1024
+)
 
 // DefaultConfig 默认配置，导出，外部可以覆盖
 var DefaultConfig = bigcache.DefaultConfig(defaultEviction)
 
 type bigcacheImpl struct {
-	cache *bigcache.BigCache
-	loads int64
-	cfg   *Config
+	*base
+	cache  *bigcache.BigCache
+	cancel context.CancelFunc // 停止bigcache后台清理协程
+	events *eventQueue        // 过期和淘汰事件，未设置EventHook时为nil
 }
 
 func init() {
@@ -24,45 +32,133 @@ func init() {
 }
 
 func newBigCache(cfg *Config) (API, error) {
-	ctx := context.Background()
+	if cfg.TTLJitter > 0 || cfg.EarlyRefreshBeta > 0 || cfg.StaleTTL > 0 {
+		return nil, fmt.Errorf("%w: bigcache does not support per-key ttl features", ErrInvalidConfig)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &bigcacheImpl{base: newBase(cfg), cancel: cancel}
+	if cfg.EventHook != nil {
+		s.events = newEventQueue(bigcacheEventBuffer, cfg.EventHook, s.stats.eventDrop)
+	}
 	config := DefaultConfig
 	config.LifeWindow = time.Duration(cfg.DefaultTTL) * time.Second
 	config.HardMaxCacheSize = cfg.MaxSizeInMB
+	config.OnRemoveWithReason = s.onRemove(DefaultConfig.OnRemoveWithReason)
 	bc, err := bigcache.New(ctx, config)
 	if err != nil {
+		cancel()
+		if s.events != nil {
+			s.events.close()
+		}
 		return nil, err
 	}
-	return &bigcacheImpl{cache: bc, cfg: cfg}, nil
+	s.cache = bc
+	return s, nil
+}
+
+// onRemove 统计过期和淘汰的key数量，并回调外部在DefaultConfig中设置的回调。
+// bigcache在分片锁中回调，过期和淘汰事件放入eventQueue异步分发，订阅者可以调用同一实例，分发不及时时丢弃
+func (s *bigcacheImpl) onRemove(next func(string, []byte, bigcache.RemoveReason)) func(string, []byte,
+	bigcache.RemoveReason) {
+	return func(key string, entry []byte, reason bigcache.RemoveReason) {
+		switch reason {
+		case bigcache.Expired:
+			s.stats.expire(1)
+			s.emitAsync(EventExpire, key)
+		case bigcache.NoSpace:
+			s.stats.evict(1)
+			s.emitAsync(EventEvict, key)
+		}
+		if next != nil {
+			next(key, entry, reason)
+		}
+	}
+}
+
+func (s *bigcacheImpl) emitAsync(typ, key string) {
+	if s.events != nil {
+		s.events.push(Event{Type: typ, Key: key})
+	}
 }
 
 // Get 获取key, 不存在返回ErrEntryNotFound, 通过输入序列化方式自动解析数据结构
 func (s *bigcacheImpl) Get(key string, value interface{}) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
 	data, err := s.cache.Get(key)
 	if len(data) == 0 || err != nil {
+		s.stats.miss()
 		return ErrNotFound
 	}
-	return s.cfg.Serializer.Unmarshal(data, value)
+	if err := s.cfg.Serializer.Unmarshal(data, value); err != nil {
+		return s.decodeError(key, value, data, false, err, func() { s.cache.Delete(key) })
+	}
+	s.stats.hit()
+	return nil
+}
+
+// GetRaw 返回key对应的原始数据，不计入统计数据
+func (s *bigcacheImpl) GetRaw(key string) ([]byte, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+	data, err := s.cache.Get(key)
+	if len(data) == 0 || err != nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
 }
 
 // GetWithLoad 返回key对应的value, 如果key不存在，使用load函数加载返回，并缓存ttl秒
 func (s *bigcacheImpl) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
-	hit, err := getWithLoad(ctx, s, key, value, load)
-	if err != nil {
+	if err := s.checkClosed(); err != nil {
 		return err
 	}
-	if !hit {
-		atomic.AddInt64(&s.loads, 1)
-	}
-	return nil
+	return s.getWithLoad(ctx, s, key, value, load)
 }
 
 // Set 保存一对<key, value>，可能因value格式不支持而保存失败, 通过输入序列化方式自动打包数据
 func (s *bigcacheImpl) Set(key string, value interface{}) error {
+	s.leases.invalidate(key)
+	return s.set(key, value)
+}
+
+// setEntry GetWithLoad回填。bigcache不支持单独指定key的过期时间，忽略LoadFunc返回的ttl，按实例的DefaultTTL过期
+func (s *bigcacheImpl) setEntry(key string, value interface{}, ttl int64, delta time.Duration) error {
+	return s.set(key, value)
+}
+
+func (s *bigcacheImpl) remove(key string) {
+	s.cache.Delete(key)
+}
+
+func (s *bigcacheImpl) set(key string, value interface{}) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
 	data, err := s.cfg.Serializer.Marshal(value)
 	if err != nil {
+		s.stats.serializeError()
 		return err
 	}
-	return s.cache.Set(key, data)
+	if len(data) > s.MaxValueSize(key) {
+		return ErrValueTooLarge
+	}
+	if err := s.cache.Set(key, data); err != nil {
+		return err
+	}
+	s.stats.set()
+	return nil
+}
+
+// MaxValueSize 每个shard最多占用HardMaxCacheSize/Shards，扣除bigcache的数据头和key，未限制容量时不限制
+func (s *bigcacheImpl) MaxValueSize(key string) int {
+	if s.cfg.MaxSizeInMB <= 0 {
+		return math.MaxInt32
+	}
+	shard := s.cfg.MaxSizeInBytes() / DefaultConfig.Shards
+	return shard - bigcacheEntryOverhead - len(key)
 }
 
 // SetWithExpire 设置key value，并制定过期时间
@@ -72,22 +168,107 @@ func (s *bigcacheImpl) SetWithExpire(key string, value interface{}, ttl int64) e
 
 // Delete 删除一个key
 func (s *bigcacheImpl) Delete(key string) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidate(key)
+	s.stats.delete()
 	return s.cache.Delete(key)
 }
 
 // Clear 清空所有元素
 func (s *bigcacheImpl) Clear() error {
-	s.loads = 0
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidateAll()
 	return s.cache.Reset()
 }
 
 // GetStats 获取统计数据
 func (s *bigcacheImpl) GetStats() Stats {
-	stats := s.cache.Stats()
-	return Stats{
-		Hits:    stats.Hits,
-		Misses:  stats.Misses,
-		HitRate: float64(stats.Hits) / float64(stats.Hits+stats.Misses),
-		Loads:   s.loads,
+	var stats Stats
+	s.fillStats(&stats)
+	stats.EntryCount = int64(s.cache.Len())
+	// bigcache只提供已分配的内存(Capacity)，不是实际占用，不填充BytesUsed
+	return stats
+}
+
+// ResetStats 重置统计数据
+func (s *bigcacheImpl) ResetStats() {
+	s.stats.reset()
+	s.cache.ResetStats()
+}
+
+// Resize 不支持运行时调整容量
+func (s *bigcacheImpl) Resize(newSizeInMB int) error {
+	return ErrNotSupported
+}
+
+// Capabilities 返回实例支持的可选特性
+func (s *bigcacheImpl) Capabilities() Capability {
+	return 0
+}
+
+// Close 关闭实例，停止bigcache后台清理协程
+func (s *bigcacheImpl) Close() error {
+	if err := s.markClosed(); err != nil {
+		return err
+	}
+	s.cancel()
+	err := s.cache.Close()
+	if s.events != nil {
+		s.events.close()
+	}
+	return err
+}
+
+// eventQueue 在单独的协程中按顺序分发事件，用于在引擎内部锁中产生的事件。
+// 缓冲区容量固定，push不阻塞，缓冲区满时丢弃事件并调用drop
+type eventQueue struct {
+	events chan Event
+	drop   func()
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newEventQueue(capacity int, hook func(Event), drop func()) *eventQueue {
+	q := &eventQueue{events: make(chan Event, capacity), drop: drop, stop: make(chan struct{}),
+		done: make(chan struct{})}
+	go q.run(hook)
+	return q
+}
+
+// push 添加一个事件，缓冲区满时丢弃
+func (q *eventQueue) push(ev Event) {
+	select {
+	case q.events <- ev:
+	default:
+		q.drop()
+	}
+}
+
+// close 分发完缓冲区中的事件后退出协程
+func (q *eventQueue) close() {
+	close(q.stop)
+	<-q.done
+}
+
+func (q *eventQueue) run(hook func(Event)) {
+	defer close(q.done)
+	for {
+		select {
+		case ev := <-q.events:
+			hook(ev)
+		case <-q.stop:
+			for {
+				select {
+				case ev := <-q.events:
+					hook(ev)
+				default:
+					return
+				}
+			}
+		}
 	}
 }
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// 熔断器状态，见Stats.BreakerState
+const (
+	BreakerClosed   = "closed"    // 正常调用LoadFunc
+	BreakerOpen     = "open"      // LoadFunc连续失败，冷却期内不再调用
+	BreakerHalfOpen = "half_open" // 冷却结束，放行一次试探调用
+)
+
+// breaker 自动加载的熔断器，每个实例一个。连续failures次加载失败后打开，
+// 冷却coolDown后放行一次试探调用，成功则关闭，失败则重新打开
+type breaker struct {
+	lock      sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	failures  int // 连续失败次数
+	state     string
+	openedAt  time.Time
+	now       func() time.Time
+}
+
+func newBreaker(threshold int, coolDown time.Duration) *breaker {
+	return &breaker{threshold: threshold, coolDown: coolDown, state: BreakerClosed, now: time.Now}
+}
+
+// allow 是否允许调用LoadFunc，半开状态只放行一个试探调用
+func (b *breaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.coolDown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// done 记录allow放行的LoadFunc调用结果，返回熔断器是否因此打开
+func (b *breaker) done(err error) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.failures, b.state = 0, BreakerClosed
+		return false
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt = BreakerOpen, b.now()
+		return true
+	}
+	return false
+}
+
+// isOpen 是否处于打开状态且还在冷却期内
+func (b *breaker) isOpen() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state == BreakerOpen && b.now().Sub(b.openedAt) < b.coolDown
+}
+
+func (b *breaker) currentState() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
@@ -0,0 +1,46 @@
+// Package cacheplugin 将cache命名实例注册为trpc-go插件，匿名导入本包即可启用：
+//
+//	import _ "git.code.oa.com/video_pay_root/pay-go-comm/tcache/cache/cacheplugin"
+//
+// trpc_go.yaml配置示例：
+//
+//	plugins:
+//	  cache:
+//	    tcache:
+//	      instances:
+//	        - name: user_profile
+//	          engine: freecache
+//	          max_size_mb: 100
+//	          default_ttl: 60
+package cacheplugin
+
+import (
+	"git.code.oa.com/trpc-go/trpc-go/plugin"
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/cache"
+)
+
+const (
+	pluginType = "cache"
+	pluginName = "tcache"
+)
+
+func init() {
+	plugin.Register(pluginName, &Factory{})
+}
+
+// Factory cache插件工厂
+type Factory struct{}
+
+// Type 插件类型
+func (f *Factory) Type() string {
+	return pluginType
+}
+
+// Setup 解析插件配置，构造并注册所有命名实例
+func (f *Factory) Setup(name string, dec plugin.Decoder) error {
+	cfg := &cache.InstancesConfig{}
+	if err := dec.Decode(cfg); err != nil {
+		return err
+	}
+	return cache.SetupInstances(cfg.Instances)
+}
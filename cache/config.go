@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"git.code.oa.com/trpc-go/trpc-go/log"
+	"gopkg.in/yaml.v3"
+)
+
+// InstanceConfig 命名cache实例的声明式配置，一般来自yaml
+type InstanceConfig struct {
+	Name        string  `yaml:"name" json:"name"`               // 实例名，通过GetInstance(name)获取
+	Engine      string  `yaml:"engine" json:"engine"`           // cache引擎名
+	MaxSizeInMB int     `yaml:"max_size_mb" json:"max_size_mb"` // cache占用的最大内存，单位MB
+	DefaultTTL  int64   `yaml:"default_ttl" json:"default_ttl"` // 默认过期时间，单位秒，0代表不限制
+	Serializer  string  `yaml:"serializer" json:"serializer"`   // 序列化方式名，为空默认json
+	Compression string  `yaml:"compression" json:"compression"` // 压缩方式名，为空或none代表不压缩
+	TTLJitter   float64 `yaml:"ttl_jitter" json:"ttl_jitter"`   // 过期时间随机浮动的比例，0~1
+	// EarlyRefreshBeta GetWithLoad提前刷新(XFetch)系数，0代表不提前刷新
+	EarlyRefreshBeta float64 `yaml:"early_refresh_beta" json:"early_refresh_beta"`
+	// StaleTTL 过期后继续保留的时间，单位秒，期间加载失败时返回过期数据
+	StaleTTL int64 `yaml:"stale_ttl" json:"stale_ttl"`
+	// BreakerFailures 自动加载连续失败多少次后熔断，0代表不熔断
+	BreakerFailures int `yaml:"breaker_failures" json:"breaker_failures"`
+	// BreakerCoolDown 熔断后多久放行一次试探加载，如"10s"
+	BreakerCoolDown time.Duration `yaml:"breaker_cooldown" json:"breaker_cooldown"`
+	// LoadTimeout GetWithLoad单次加载的超时时间，如"3s"，0代表不限制
+	LoadTimeout time.Duration `yaml:"load_timeout" json:"load_timeout"`
+	// MaxConcurrentLoads 同时执行的LoadFunc数量上限，0代表不限制
+	MaxConcurrentLoads int `yaml:"max_concurrent_loads" json:"max_concurrent_loads"`
+	// CopyPolicy localcache读写value时的拷贝策略：none/clone/serialize，为空代表none
+	CopyPolicy string `yaml:"copy_policy" json:"copy_policy"`
+	// MutationCheck 开启localcache的value修改检测，仅用于调试
+	MutationCheck bool `yaml:"mutation_check" json:"mutation_check"`
+}
+
+// copyPolicies 配置中的拷贝策略名
+var copyPolicies = map[string]CopyPolicy{"": CopyNone, "none": CopyNone, "clone": CopyClone, "serialize": CopySerialize}
+
+// InstancesConfig 多个命名cache实例的配置，对应yaml中的instances块：
+//
+//	instances:
+//	  - name: user_profile
+//	    engine: freecache
+//	    max_size_mb: 100
+//	    default_ttl: 60
+//	    serializer: json
+//	    compression: gzip
+//	    ttl_jitter: 0.1
+type InstancesConfig struct {
+	Instances []*InstanceConfig `yaml:"instances"`
+}
+
+type namedInstance struct {
+	api API
+	cfg *InstanceConfig
+}
+
+var (
+	instanceLock = sync.RWMutex{}
+	instances    = make(map[string]*namedInstance)
+)
+
+// Validate 校验配置是否合法
+func (c *InstanceConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidConfig)
+	}
+	if GetConstructor(c.Engine) == nil {
+		return fmt.Errorf("%w: instance %s: no such engine %q", ErrInvalidConfig, c.Name, c.Engine)
+	}
+	if c.MaxSizeInMB <= 0 {
+		return fmt.Errorf("%w: instance %s: max_size_mb must be positive", ErrInvalidConfig, c.Name)
+	}
+	if c.DefaultTTL < 0 {
+		return fmt.Errorf("%w: instance %s: default_ttl must not be negative", ErrInvalidConfig, c.Name)
+	}
+	if c.TTLJitter < 0 || c.TTLJitter > 1 {
+		return fmt.Errorf("%w: instance %s: ttl_jitter must be between 0 and 1", ErrInvalidConfig, c.Name)
+	}
+	if c.EarlyRefreshBeta < 0 {
+		return fmt.Errorf("%w: instance %s: early_refresh_beta must not be negative", ErrInvalidConfig, c.Name)
+	}
+	if c.StaleTTL < 0 {
+		return fmt.Errorf("%w: instance %s: stale_ttl must not be negative", ErrInvalidConfig, c.Name)
+	}
+	if c.BreakerFailures < 0 || (c.BreakerFailures > 0 && c.BreakerCoolDown <= 0) {
+		return fmt.Errorf("%w: instance %s: breaker_failures needs a positive breaker_cooldown",
+			ErrInvalidConfig, c.Name)
+	}
+	if c.LoadTimeout < 0 {
+		return fmt.Errorf("%w: instance %s: load_timeout must not be negative", ErrInvalidConfig, c.Name)
+	}
+	if c.MaxConcurrentLoads < 0 {
+		return fmt.Errorf("%w: instance %s: max_concurrent_loads must not be negative", ErrInvalidConfig, c.Name)
+	}
+	if (c.TTLJitter > 0 || c.EarlyRefreshBeta > 0 || c.StaleTTL > 0) && c.Engine == EngineBigCache {
+		return fmt.Errorf("%w: instance %s: bigcache does not support ttl_jitter, early_refresh_beta or stale_ttl",
+			ErrInvalidConfig, c.Name)
+	}
+	if c.Serializer != "" && GetSerializer(c.Serializer) == nil {
+		return fmt.Errorf("%w: instance %s: no such serializer %q", ErrInvalidConfig, c.Name, c.Serializer)
+	}
+	if c.compressed() && GetCompressor(c.Compression) == nil {
+		return fmt.Errorf("%w: instance %s: no such compression %q", ErrInvalidConfig, c.Name, c.Compression)
+	}
+	// localcache只在拷贝和修改检测时使用序列化，保存的数据不压缩
+	if c.Engine == EngineLocalCache && c.compressed() {
+		return fmt.Errorf("%w: instance %s: localcache does not support compression", ErrInvalidConfig, c.Name)
+	}
+	if _, ok := copyPolicies[c.CopyPolicy]; !ok {
+		return fmt.Errorf("%w: instance %s: no such copy_policy %q", ErrInvalidConfig, c.Name, c.CopyPolicy)
+	}
+	if (copyPolicies[c.CopyPolicy] != CopyNone || c.MutationCheck) && c.Engine != EngineLocalCache {
+		return fmt.Errorf("%w: instance %s: copy_policy and mutation_check are only supported by localcache",
+			ErrInvalidConfig, c.Name)
+	}
+	return nil
+}
+
+func (c *InstanceConfig) compressed() bool {
+	return c.Compression != "" && c.Compression != CompressionNone
+}
+
+// options 将声明式配置转换为Option列表
+func (c *InstanceConfig) options() []Option {
+	opts := []Option{WithDefaultTTL(c.DefaultTTL), WithTTLJitter(c.TTLJitter), WithEarlyRefresh(c.EarlyRefreshBeta),
+		WithStaleIfError(c.StaleTTL), WithCircuitBreaker(c.BreakerFailures, c.BreakerCoolDown),
+		WithLoadTimeout(c.LoadTimeout), WithMaxConcurrentLoads(c.MaxConcurrentLoads),
+		WithCopyPolicy(copyPolicies[c.CopyPolicy]), WithMutationCheck(c.MutationCheck)}
+	if c.Serializer != "" {
+		opts = append(opts, WithSerializer(GetSerializer(c.Serializer)))
+	}
+	if c.compressed() {
+		opts = append(opts, WithCompressor(GetCompressor(c.Compression)))
+	}
+	return opts
+}
+
+// NewFromConfig 根据声明式配置构造cache实例，额外的opts会覆盖配置中的同名选项
+func NewFromConfig(cfg *InstanceConfig, opts ...Option) (API, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg.Engine, cfg.MaxSizeInMB, append(cfg.options(), opts...)...)
+}
+
+// SetupInstances 根据配置批量构造命名实例并注册，任一配置不合法或构造失败则一个都不注册，已构造的实例被关闭。
+// 同名的旧实例被替换，由SetupInstances构造的旧实例会被关闭，之后通过旧实例调用返回ErrClosed
+func SetupInstances(cfgs []*InstanceConfig) error {
+	names := make(map[string]bool, len(cfgs))
+	for _, cfg := range cfgs {
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("%w: duplicate instance %s", ErrInvalidConfig, cfg.Name)
+		}
+		names[cfg.Name] = true
+	}
+	built := make([]*namedInstance, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		api, err := NewFromConfig(cfg)
+		if err != nil {
+			closeInstances(built)
+			return fmt.Errorf("instance %s: %w", cfg.Name, err)
+		}
+		built = append(built, &namedInstance{api: api, cfg: cfg})
+	}
+	var replaced []*namedInstance
+	instanceLock.Lock()
+	for _, inst := range built {
+		if old, ok := instances[inst.cfg.Name]; ok && old.cfg != nil {
+			replaced = append(replaced, old)
+		}
+		instances[inst.cfg.Name] = inst
+	}
+	instanceLock.Unlock()
+	closeInstances(replaced)
+	return nil
+}
+
+// closeInstances 关闭SetupInstances构造的实例，RegisterInstance注册的实例由调用方管理
+func closeInstances(list []*namedInstance) {
+	for _, inst := range list {
+		if err := CloseInstance(inst.api); err != nil {
+			log.Errorf("close cache instance %s failed: %v", inst.cfg.Name, err)
+		}
+	}
+}
+
+// SetupFromYAML 解析yaml格式的InstancesConfig，并构造注册所有命名实例
+func SetupFromYAML(data []byte) error {
+	cfg := &InstancesConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return SetupInstances(cfg.Instances)
+}
+
+// RegisterInstance 注册一个命名实例，同名实例会被覆盖
+func RegisterInstance(name string, api API) {
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+	instances[name] = &namedInstance{api: api}
+}
+
+// GetInstance 根据实例名返回命名实例，不存在返回nil
+func GetInstance(name string) API {
+	instanceLock.RLock()
+	defer instanceLock.RUnlock()
+	if inst, ok := instances[name]; ok {
+		return inst.api
+	}
+	return nil
+}
+
+// GetInstanceConfig 返回命名实例的声明式配置，通过RegisterInstance注册的实例返回nil
+func GetInstanceConfig(name string) *InstanceConfig {
+	instanceLock.RLock()
+	defer instanceLock.RUnlock()
+	if inst, ok := instances[name]; ok {
+		return inst.cfg
+	}
+	return nil
+}
+
+// InstanceNames 返回所有命名实例的名字，按字典序排列
+func InstanceNames() []string {
+	instanceLock.RLock()
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	instanceLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   *InstanceConfig
+		valid bool
+	}{
+		{"ok", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1}, true},
+		{"gzip", &InstanceConfig{Name: "a", Engine: EngineFastCache, MaxSizeInMB: 1, Compression: CompressionGzip}, true},
+		{"empty name", &InstanceConfig{Engine: EngineFreeCache, MaxSizeInMB: 1}, false},
+		{"no engine", &InstanceConfig{Name: "a", Engine: "xxx", MaxSizeInMB: 1}, false},
+		{"zero size", &InstanceConfig{Name: "a", Engine: EngineFreeCache}, false},
+		{"negative ttl", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, DefaultTTL: -1}, false},
+		{"no serializer", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, Serializer: "xxx"}, false},
+		{"no compression", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, Compression: "xxx"}, false},
+		{"jitter", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, TTLJitter: 0.1}, true},
+		{"jitter too large", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, TTLJitter: 2}, false},
+		{"bigcache jitter", &InstanceConfig{Name: "a", Engine: EngineBigCache, MaxSizeInMB: 1, TTLJitter: 0.1}, false},
+		{"negative beta", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, EarlyRefreshBeta: -1}, false},
+		{"bigcache beta", &InstanceConfig{Name: "a", Engine: EngineBigCache, MaxSizeInMB: 1, EarlyRefreshBeta: 1}, false},
+		{"breaker", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, StaleTTL: 60,
+			BreakerFailures: 3, BreakerCoolDown: time.Second}, true},
+		{"breaker no cooldown", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, BreakerFailures: 3}, false},
+		{"load limits", &InstanceConfig{Name: "a", Engine: EngineBigCache, MaxSizeInMB: 1, LoadTimeout: time.Second,
+			MaxConcurrentLoads: 8}, true},
+		{"negative load timeout", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, LoadTimeout: -1}, false},
+		{"bigcache stale", &InstanceConfig{Name: "a", Engine: EngineBigCache, MaxSizeInMB: 1, StaleTTL: 60}, false},
+		{"localcache gzip", &InstanceConfig{Name: "a", Engine: EngineLocalCache, MaxSizeInMB: 1, Compression: "gzip"}, false},
+		{"localcache serializer", &InstanceConfig{Name: "a", Engine: EngineLocalCache, MaxSizeInMB: 1, Serializer: "json",
+			CopyPolicy: "serialize", MutationCheck: true}, true},
+		{"no copy policy", &InstanceConfig{Name: "a", Engine: EngineLocalCache, MaxSizeInMB: 1, CopyPolicy: "xxx"}, false},
+		{"freecache copy policy", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, CopyPolicy: "clone"}, false},
+		{"freecache mutation check", &InstanceConfig{Name: "a", Engine: EngineFreeCache, MaxSizeInMB: 1, MutationCheck: true}, false},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if tt.valid {
+			assert.Nil(t, err, tt.name)
+		} else {
+			assert.True(t, errors.Is(err, ErrInvalidConfig), tt.name)
+		}
+	}
+}
+
+func TestSetupFromYAML(t *testing.T) {
+	data := []byte(`
+instances:
+  - name: user_profile
+    engine: freecache
+    max_size_mb: 10
+    default_ttl: 60
+    serializer: json
+    compression: gzip
+    stale_ttl: 60
+    breaker_failures: 3
+    breaker_cooldown: 10s
+    load_timeout: 3s
+    max_concurrent_loads: 16
+  - name: local
+    engine: localcache
+    max_size_mb: 10
+    serializer: json
+    copy_policy: clone
+    mutation_check: true
+`)
+	assert.Nil(t, SetupFromYAML(data))
+	assert.Subset(t, InstanceNames(), []string{"local", "user_profile"})
+	assert.Equal(t, EngineFreeCache, GetInstanceConfig("user_profile").Engine)
+	assert.Equal(t, 10*time.Second, GetInstanceConfig("user_profile").BreakerCoolDown)
+	assert.Equal(t, 3*time.Second, GetInstanceConfig("user_profile").LoadTimeout)
+	assert.Equal(t, BreakerClosed, GetInstance("user_profile").GetStats().BreakerState)
+	assert.Nil(t, GetInstance("xxx"))
+
+	c := GetInstance("user_profile")
+	var value []string
+	assert.Nil(t, c.Set("foo", []string{"bar"}))
+	assert.Nil(t, c.Get("foo", &value))
+	assert.Equal(t, []string{"bar"}, value)
+	local := GetInstance("local")
+	assert.Nil(t, local.Set("foo", []string{"bar"}))
+	value = nil
+	assert.Nil(t, local.Get("foo", &value))
+	assert.Equal(t, []string{"bar"}, value)
+	assert.Equal(t, CopyClone, Unwrap(local).(*localcacheImpl).cfg.CopyPolicy)
+	assert.True(t, Unwrap(local).(*localcacheImpl).cfg.MutationCheck)
+
+	// 重名实例整体失败
+	dup := []byte(`
+instances:
+  - {name: a, engine: freecache, max_size_mb: 1}
+  - {name: a, engine: freecache, max_size_mb: 1}
+`)
+	assert.True(t, errors.Is(SetupFromYAML(dup), ErrInvalidConfig))
+	assert.Nil(t, GetInstance("a"))
+}
+
+func TestSetupInstancesClose(t *testing.T) {
+	var created []API
+	Register("setup_test", func(cfg *Config) (API, error) {
+		if cfg.MaxSizeInMB > 1 {
+			return nil, errors.New("too large")
+		}
+		api, err := newFreeCache(cfg)
+		created = append(created, api)
+		return api, err
+	})
+
+	// 构造失败时关闭已构造的实例
+	err := SetupInstances([]*InstanceConfig{
+		{Name: "setup_a", Engine: "setup_test", MaxSizeInMB: 1},
+		{Name: "setup_b", Engine: "setup_test", MaxSizeInMB: 2},
+	})
+	assert.NotNil(t, err)
+	assert.True(t, GetInstance("setup_a") != created[0])
+	assert.Nil(t, GetInstance("setup_b"))
+	assert.Equal(t, ErrClosed, created[0].Set("k", 1))
+
+	// 替换同名实例时关闭旧实例
+	cfgs := []*InstanceConfig{{Name: "setup_a", Engine: "setup_test", MaxSizeInMB: 1}}
+	assert.Nil(t, SetupInstances(cfgs))
+	old := GetInstance("setup_a")
+	assert.Nil(t, SetupInstances(cfgs))
+	assert.Equal(t, ErrClosed, old.Set("k", 1))
+	assert.Nil(t, GetInstance("setup_a").Set("k", 1))
+	assert.Nil(t, CloseInstance(GetInstance("setup_a")))
+}
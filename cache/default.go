@@ -2,54 +2,173 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 )
 
 const defaultSize = 500 // 500MB
 
+// ErrDefaultInUse 默认实例已经被使用，不能再替换或重新配置
+var ErrDefaultInUse = errors.New("default cache already in use")
+
+// ErrNotInitialized 默认实例尚未构造
+var ErrNotInitialized = errors.New("default cache not initialized")
+
 var (
-	defaultCache API // 默认cache实例，方便使用
+	defaultCache API   // 默认cache实例，方便使用
+	defaultErr   error // 默认cache实例构造失败的错误
+	defaultNew   = func() (API, error) { return New(EngineFreeCache, defaultSize) }
+	defaultUsed  bool
+	defaultLock  = sync.Mutex{}
 	once         sync.Once
 )
 
-func getDefault() API {
+func getDefault() (API, error) {
 	once.Do(func() {
-		defaultCache, _ = New(EngineFreeCache, defaultSize)
+		defaultLock.Lock()
+		defer defaultLock.Unlock()
+		defaultUsed = true
+		if defaultCache == nil {
+			defaultCache, defaultErr = defaultNew()
+		}
 	})
-	return defaultCache
+	return defaultCache, defaultErr
+}
+
+// SetDefault 替换默认cache实例，必须在第一次使用默认实例前调用，否则返回ErrDefaultInUse
+func SetDefault(api API) error {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	if defaultUsed {
+		return ErrDefaultInUse
+	}
+	defaultCache = api
+	return nil
+}
+
+// ConfigureDefault 指定默认cache实例的引擎、大小和选项，实例在第一次使用时才构造，
+// 构造失败的错误由后续调用返回。必须在第一次使用默认实例前调用，否则返回ErrDefaultInUse
+func ConfigureDefault(engine string, maxSizeInMB int, opts ...Option) error {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	if defaultUsed {
+		return ErrDefaultInUse
+	}
+	defaultCache = nil
+	defaultNew = func() (API, error) { return New(engine, maxSizeInMB, opts...) }
+	return nil
 }
 
 // Get 获取key, 不存在返回ErrEntryNotFound
 func Get(key string, value interface{}) error {
-	return getDefault().Get(key, value)
+	c, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return c.Get(key, value)
 }
 
 // GetWithLoad 返回key对应的value, 如果key不存在，使用load函数加载返回，并缓存ttl秒
 func GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
-	return getDefault().GetWithLoad(ctx, key, value, load)
+	c, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return c.GetWithLoad(ctx, key, value, load)
 }
 
 // Set 保存一对<key, value>，可能因value格式不支持序列化而保存失败
 func Set(key string, value interface{}) error {
-	return getDefault().Set(key, value)
+	c, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return c.Set(key, value)
 }
 
 // SetWithExpire 设置key value，并制定过期时间
 func SetWithExpire(key string, value interface{}, ttl int64) error {
-	return getDefault().SetWithExpire(key, value, ttl)
+	c, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return c.SetWithExpire(key, value, ttl)
 }
 
 // Delete 删除一个key
 func Delete(key string) error {
-	return getDefault().Delete(key)
+	c, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return c.Delete(key)
 }
 
 // Clear 清空所有元素
 func Clear() error {
-	return getDefault().Clear()
+	c, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return c.Clear()
 }
 
-// GetStats 获取统计数据
+// GetStats 获取统计数据，默认实例尚未构造或构造失败时返回空数据
 func GetStats() Stats {
-	return getDefault().GetStats()
+	c, ok := createdDefault()
+	if !ok {
+		return Stats{}
+	}
+	return c.GetStats()
+}
+
+// GetWindowStats 获取默认实例最近window时间内的统计数据，默认实例尚未构造或构造失败时返回空数据
+func GetWindowStats(window time.Duration) WindowStats {
+	c, ok := createdDefault()
+	if !ok {
+		return WindowStats{}
+	}
+	return GetInstanceWindowStats(c, window)
+}
+
+// ResetStats 重置默认实例的统计数据，默认实例尚未构造时不做处理
+func ResetStats() {
+	if c, ok := createdDefault(); ok {
+		ResetInstanceStats(c)
+	}
+}
+
+// Resize 运行时调整默认实例占用的最大内存，单位MB。默认实例尚未构造时返回ErrNotInitialized，构造前可通过ConfigureDefault指定大小
+func Resize(newSizeInMB int) error {
+	c, ok := createdDefault()
+	if !ok {
+		return ErrNotInitialized
+	}
+	return ResizeInstance(c, newSizeInMB)
+}
+
+// Capabilities 返回默认实例支持的可选特性，默认实例尚未构造或构造失败时返回0
+func Capabilities() Capability {
+	c, ok := createdDefault()
+	if !ok {
+		return 0
+	}
+	return GetInstanceCapabilities(c)
+}
+
+// Close 关闭默认实例，关闭后其他接口返回ErrClosed。默认实例尚未构造时不做处理
+func Close() error {
+	c, ok := createdDefault()
+	if !ok {
+		return nil
+	}
+	return CloseInstance(c)
+}
+
+// createdDefault 返回已构造或通过SetDefault指定的默认实例，不会触发构造
+func createdDefault() (API, bool) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	return defaultCache, defaultCache != nil
 }
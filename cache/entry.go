@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// clock 判断entry过期使用的时钟，测试时可替换
+var clock = time.Now
+
+// errStale key已过期，但还在StaleTTL内，可以在加载失败时返回
+var errStale = errors.New("stale")
+
+// entryHeaderSize 序列化引擎(freecache/fastcache)保存的数据头：过期时间8字节 + 加载耗时4字节(微秒)
+const entryHeaderSize = 12
+
+// entryMeta 随entry保存的元数据
+type entryMeta struct {
+	expire int64         // 过期时间，unix秒，0代表不过期
+	delta  time.Duration // 生成该entry的LoadFunc耗时，不是由GetWithLoad写入的为0
+}
+
+// entryWriter GetWithLoad回填时使用的写接口，所有引擎都已实现。与SetWithExpire不同，不会使租约失效
+type entryWriter interface {
+	// setEntry 同SetWithExpire，支持entryStore的引擎额外保存加载耗时。ttl已由调用方按TTLJitter调整
+	setEntry(key string, value interface{}, ttl int64, delta time.Duration) error
+	// remove 删除key，不使租约失效，用于撤销租约失效后完成的回填
+	remove(key string)
+}
+
+// entryStore 支持读写entry元数据的引擎，GetWithLoad通过它实现提前刷新(XFetch)
+type entryStore interface {
+	entryWriter
+	// getEntry 同Get，额外返回entry的元数据。stale为false时，已过期但还在StaleTTL内的key返回errStale，不解析value；
+	// stale为true时也返回这类key，且不计入统计数据，用于加载失败时返回过期数据
+	getEntry(key string, value interface{}, stale bool) (entryMeta, error)
+}
+
+func newEntryMeta(ttl int64, delta time.Duration) entryMeta {
+	meta := entryMeta{delta: delta}
+	if ttl > 0 {
+		meta.expire = clock().Unix() + ttl
+	}
+	return meta
+}
+
+// expired entry是否已过期
+func (m entryMeta) expired() bool {
+	return m.expire > 0 && m.expire < clock().Unix()
+}
+
+// dead entry是否已超过过期数据的保留时间staleTTL
+func (m entryMeta) dead(staleTTL int64) bool {
+	return m.expire > 0 && m.expire+staleTTL < clock().Unix()
+}
+
+// storeTTL 引擎实际保存的时间，过期后再保留staleTTL
+func storeTTL(ttl, staleTTL int64) int64 {
+	if ttl <= 0 {
+		return ttl
+	}
+	return ttl + staleTTL
+}
+
+// wrapEntry 在序列化后的value前加上数据头
+func wrapEntry(meta entryMeta, value []byte) []byte {
+	delta := (meta.delta + time.Microsecond - 1) / time.Microsecond // 向上取整，保留非0的耗时
+	if delta > math.MaxUint32 {
+		delta = math.MaxUint32
+	}
+	entry := make([]byte, entryHeaderSize+len(value))
+	binary.LittleEndian.PutUint64(entry, uint64(meta.expire))
+	binary.LittleEndian.PutUint32(entry[8:], uint32(delta))
+	copy(entry[entryHeaderSize:], value)
+	return entry
+}
+
+// readEntry 解析数据头，返回元数据和value的拷贝
+func readEntry(entry []byte) (meta entryMeta, value []byte) {
+	meta.expire = int64(binary.LittleEndian.Uint64(entry))
+	meta.delta = time.Duration(binary.LittleEndian.Uint32(entry[8:])) * time.Microsecond
+	// copy on read
+	value = make([]byte, len(entry)-entryHeaderSize)
+	copy(value, entry[entryHeaderSize:])
+	return meta, value
+}
@@ -2,57 +2,93 @@ package cache
 
 import (
 	"context"
-	"encoding/binary"
-	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/fastcache"
 )
 
+// fastcacheMaxEntry fastcache单个entry最大字节数：4字节长度头 + key + value 小于64KB
+const fastcacheMaxEntry = 64*1024 - 1 - 4
+
 type fastcacheImpl struct {
-	cache  *fastcache.Cache
-	loads  int64
-	misses int64
-	cfg    *Config
+	*base
+	cache *fastcache.Cache
 }
 
-const (
-	timestampSizeInBytes = 8 // 用于保存时戳的字节数
-)
-
 func init() {
 	Register(EngineFastCache, newFastCache)
 }
 
 func newFastCache(cfg *Config) (API, error) {
-	return &fastcacheImpl{cache: fastcache.New(cfg.MaxSizeInBytes()), cfg: cfg}, nil
+	return &fastcacheImpl{base: newBase(cfg), cache: fastcache.New(cfg.MaxSizeInBytes())}, nil
 }
 
 // Get 获取key, 不存在返回ErrEntryNotFound, 通过输入序列化方式自动解析数据结构
 func (s *fastcacheImpl) Get(key string, value interface{}) error {
+	_, err := s.getEntry(key, value, false)
+	if err == errStale {
+		return ErrNotFound
+	}
+	return err
+}
+
+// getEntry 获取key及其元数据
+func (s *fastcacheImpl) getEntry(key string, value interface{}, stale bool) (entryMeta, error) {
+	if err := s.checkClosed(); err != nil {
+		return entryMeta{}, err
+	}
 	var entry []byte
 	if entry = s.cache.Get(entry, str2bytes(key)); len(entry) == 0 {
-		return ErrNotFound
+		if !stale {
+			s.stats.miss()
+		}
+		return entryMeta{}, ErrNotFound
 	}
-	expire, data := readEntry(entry)
-	if expire > 0 && expire < uint64(time.Now().Unix()) {
-		s.Delete(key)
-		atomic.AddInt64(&s.misses, 1)
-		return ErrNotFound
+	meta, data := readEntry(entry)
+	if meta.dead(s.cfg.StaleTTL) {
+		s.cache.Del(str2bytes(key))
+		s.stats.expire(1)
+		s.emit(EventExpire, key, 0)
+		if !stale {
+			s.stats.miss()
+		}
+		return entryMeta{}, ErrNotFound
+	}
+	if !stale && meta.expired() {
+		s.stats.miss()
+		return meta, errStale
+	}
+	if err := s.cfg.Serializer.Unmarshal(data, value); err != nil {
+		return entryMeta{}, s.decodeError(key, value, data, stale, err, func() { s.cache.Del(str2bytes(key)) })
 	}
-	return s.cfg.Serializer.Unmarshal(data, value)
+	if !stale {
+		s.stats.hit()
+	}
+	return meta, nil
+}
+
+// GetRaw 返回key对应的原始数据(不含数据头)，不计入统计数据
+func (s *fastcacheImpl) GetRaw(key string) ([]byte, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+	var entry []byte
+	if entry = s.cache.Get(entry, str2bytes(key)); len(entry) == 0 {
+		return nil, ErrNotFound
+	}
+	meta, data := readEntry(entry)
+	if meta.dead(s.cfg.StaleTTL) {
+		return nil, ErrNotFound
+	}
+	return data, nil
 }
 
 // GetWithLoad 返回key对应的value, 如果key不存在，使用load函数加载返回，并缓存ttl秒
 func (s *fastcacheImpl) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
-	hit, err := getWithLoad(ctx, s, key, value, load)
-	if err != nil {
+	if err := s.checkClosed(); err != nil {
 		return err
 	}
-	if !hit {
-		atomic.AddInt64(&s.loads, 1)
-	}
-	return nil
+	return s.getWithLoad(ctx, s, key, value, load)
 }
 
 // Set 保存一对<key, value>，可能因value格式不支持而保存失败, 通过输入序列化方式自动打包数据
@@ -62,56 +98,89 @@ func (s *fastcacheImpl) Set(key string, value interface{}) error {
 
 // SetWithExpire 设置key value，并制定过期时间
 func (s *fastcacheImpl) SetWithExpire(key string, value interface{}, ttl int64) error {
-	var expire int64
-	if ttl > 0 {
-		expire = time.Now().Unix() + ttl
+	s.leases.invalidate(key)
+	return s.setEntry(key, value, s.jitter(ttl), 0)
+}
+
+// setEntry 设置key value，并在数据头中保存过期时间和加载耗时
+func (s *fastcacheImpl) setEntry(key string, value interface{}, ttl int64, delta time.Duration) error {
+	if err := s.checkClosed(); err != nil {
+		return err
 	}
 	data, err := s.cfg.Serializer.Marshal(value)
 	if err != nil {
+		s.stats.serializeError()
 		return err
 	}
-	s.cache.Set(str2bytes(key), wrapEntry(uint64(expire), data))
+	if len(data) > s.MaxValueSize(key) {
+		return ErrValueTooLarge
+	}
+	s.cache.Set(str2bytes(key), wrapEntry(newEntryMeta(ttl, delta), data))
+	s.stats.set()
 	return nil
 }
 
+func (s *fastcacheImpl) remove(key string) {
+	s.cache.Del(str2bytes(key))
+}
+
+// MaxValueSize fastcache不保存key和value共超过64KB的entry，扣除长度头、entry数据头和key
+func (s *fastcacheImpl) MaxValueSize(key string) int {
+	return fastcacheMaxEntry - entryHeaderSize - len(key)
+}
+
 // Delete 删除一个key
 func (s *fastcacheImpl) Delete(key string) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidate(key)
+	s.stats.delete()
 	s.cache.Del(str2bytes(key))
 	return nil
 }
 
 // Clear 清空所有元素
 func (s *fastcacheImpl) Clear() error {
-	s.loads = 0
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidateAll()
 	s.cache.Reset()
 	return nil
 }
 
 // GetStats 获取统计数据
 func (s *fastcacheImpl) GetStats() Stats {
-	var stats fastcache.Stats
-	s.cache.UpdateStats(&stats)
-	misses := int64(stats.Misses) + s.misses
-	hits := int64(stats.GetCalls) - misses
-	return Stats{
-		Hits:    hits,
-		Misses:  misses,
-		HitRate: float64(hits) / float64(stats.GetCalls),
-		Loads:   s.loads,
-	}
-}
-
-func wrapEntry(timestamp uint64, value []byte) []byte {
-	entry := make([]byte, timestampSizeInBytes+len(value))
-	binary.LittleEndian.PutUint64(entry, timestamp)
-	copy(entry[timestampSizeInBytes:], value)
-	return entry
-}
-
-func readEntry(entry []byte) (timestamp uint64, value []byte) {
-	timestamp = binary.LittleEndian.Uint64(entry)
-	// copy on read
-	value = make([]byte, len(entry)-timestampSizeInBytes)
-	copy(value, entry[timestampSizeInBytes:])
-	return timestamp, value
+	var cacheStats fastcache.Stats
+	s.cache.UpdateStats(&cacheStats)
+	var stats Stats
+	s.fillStats(&stats)
+	stats.EntryCount = int64(cacheStats.EntriesCount)
+	stats.BytesUsed = int64(cacheStats.BytesSize)
+	return stats
+}
+
+// ResetStats 重置统计数据
+func (s *fastcacheImpl) ResetStats() {
+	s.stats.reset()
+}
+
+// Resize 不支持运行时调整容量
+func (s *fastcacheImpl) Resize(newSizeInMB int) error {
+	return ErrNotSupported
+}
+
+// Capabilities 返回实例支持的可选特性
+func (s *fastcacheImpl) Capabilities() Capability {
+	return CapPerKeyTTL | CapBytesUsed
+}
+
+// Close 关闭实例，释放内存
+func (s *fastcacheImpl) Close() error {
+	if err := s.markClosed(); err != nil {
+		return err
+	}
+	s.cache.Reset()
+	return nil
 }
@@ -2,15 +2,24 @@ package cache
 
 import (
 	"context"
+	"math"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/coocood/freecache"
 )
 
 type freecacheImpl struct {
-	cache *freecache.Cache
-	loads int64
-	cfg   *Config
+	*base
+	lock  sync.RWMutex     // 保护cache和old的切换
+	cache *freecache.Cache // 当前实例
+	old   *freecache.Cache // Resize迁移中的旧实例，迁移完成后为nil
+	size  int64            // 当前实例的容量，单位字节，原子读写。Resize不修改共享的cfg
+	wg    sync.WaitGroup   // 等待迁移协程退出
+
+	retiredEvictions   int64 // 已迁移完成的旧实例的淘汰数量
+	retiredExpirations int64 // 已迁移完成的旧实例的过期数量
 }
 
 func init() {
@@ -18,28 +27,82 @@ func init() {
 }
 
 func newFreeCache(cfg *Config) (API, error) {
-	return &freecacheImpl{cache: freecache.NewCache(cfg.MaxSizeInBytes()), cfg: cfg}, nil
+	return &freecacheImpl{base: newBase(cfg), cache: freecache.NewCache(cfg.MaxSizeInBytes()),
+		size: int64(cfg.MaxSizeInBytes())}, nil
 }
 
 // Get 获取key, 不存在返回ErrEntryNotFound, 通过输入序列化方式自动解析数据结构
 func (s *freecacheImpl) Get(key string, value interface{}) error {
-	data, err := s.cache.Get(str2bytes(key))
-	if len(data) == 0 || err != nil {
+	_, err := s.getEntry(key, value, false)
+	if err == errStale {
 		return ErrNotFound
 	}
-	return s.cfg.Serializer.Unmarshal(data, value)
+	return err
+}
+
+// getEntry 获取key及其元数据
+func (s *freecacheImpl) getEntry(key string, value interface{}, stale bool) (entryMeta, error) {
+	if err := s.checkClosed(); err != nil {
+		return entryMeta{}, err
+	}
+	data, err := s.peek(key, !stale)
+	if err != nil {
+		if !stale {
+			s.stats.miss()
+		}
+		return entryMeta{}, ErrNotFound
+	}
+	meta, data := readEntry(data)
+	if !stale && meta.expired() {
+		s.stats.miss()
+		return meta, errStale
+	}
+	if err := s.cfg.Serializer.Unmarshal(data, value); err != nil {
+		return entryMeta{}, s.decodeError(key, value, data, stale, err, func() { s.remove(key) })
+	}
+	if !stale {
+		s.stats.hit()
+	}
+	return meta, nil
+}
+
+// peek 从当前实例读取key，迁移中当前实例还没有的key从旧实例读取。touch为false时不更新freecache的统计和访问时间
+func (s *freecacheImpl) peek(key string, touch bool) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	get := s.cache.Peek
+	if touch {
+		get = s.cache.Get
+	}
+	data, err := get(str2bytes(key))
+	if (len(data) == 0 || err != nil) && s.old != nil {
+		data, err = s.old.Peek(str2bytes(key))
+	}
+	if len(data) < entryHeaderSize || err != nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+// GetRaw 返回key对应的原始数据(不含数据头)，不计入统计数据
+func (s *freecacheImpl) GetRaw(key string) ([]byte, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+	data, err := s.peek(key, false)
+	if err != nil {
+		return nil, err
+	}
+	_, data = readEntry(data)
+	return data, nil
 }
 
 // GetWithLoad 返回key对应的value, 如果key不存在，使用load函数加载返回，并缓存ttl秒
 func (s *freecacheImpl) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
-	hit, err := getWithLoad(ctx, s, key, value, load)
-	if err != nil {
+	if err := s.checkClosed(); err != nil {
 		return err
 	}
-	if !hit {
-		atomic.AddInt64(&s.loads, 1)
-	}
-	return nil
+	return s.getWithLoad(ctx, s, key, value, load)
 }
 
 // Set 保存一对<key, value>，可能因value格式不支持而保存失败, 通过输入序列化方式自动打包数据
@@ -49,32 +112,180 @@ func (s *freecacheImpl) Set(key string, value interface{}) error {
 
 // SetWithExpire 设置key value，并制定过期时间
 func (s *freecacheImpl) SetWithExpire(key string, value interface{}, ttl int64) error {
+	s.leases.invalidate(key)
+	return s.setEntry(key, value, s.jitter(ttl), 0)
+}
+
+// setEntry 设置key value，并在数据头中保存过期时间和加载耗时
+func (s *freecacheImpl) setEntry(key string, value interface{}, ttl int64, delta time.Duration) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
 	data, err := s.cfg.Serializer.Marshal(value)
 	if err != nil {
+		s.stats.serializeError()
 		return err
 	}
-	return s.cache.Set(str2bytes(key), data, int(ttl))
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(data) > s.maxValueSize(key) {
+		return ErrValueTooLarge
+	}
+	entry := wrapEntry(newEntryMeta(ttl, delta), data)
+	if err := s.cache.Set(str2bytes(key), entry, int(storeTTL(ttl, s.cfg.StaleTTL))); err != nil {
+		return err
+	}
+	s.stats.set()
+	return nil
+}
+
+// MaxValueSize freecache每个entry最多占用容量的1/1024，扣除freecache的数据头、entry数据头和key
+func (s *freecacheImpl) MaxValueSize(key string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.maxValueSize(key)
+}
+
+// maxValueSize 同MaxValueSize，需持有读锁
+func (s *freecacheImpl) maxValueSize(key string) int {
+	if len(key) > math.MaxUint16 {
+		return 0
+	}
+	return int(atomic.LoadInt64(&s.size))/1024 - freecache.ENTRY_HDR_SIZE - entryHeaderSize - len(key)
 }
 
 // Delete 删除一个key
 func (s *freecacheImpl) Delete(key string) error {
-	s.cache.Del(str2bytes(key))
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidate(key)
+	s.stats.delete()
+	s.remove(key)
 	return nil
 }
 
+// remove 从当前实例和迁移中的旧实例删除key
+func (s *freecacheImpl) remove(key string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.cache.Del(str2bytes(key))
+	if s.old != nil {
+		s.old.Del(str2bytes(key))
+	}
+}
+
 // Clear 清空所有元素
 func (s *freecacheImpl) Clear() error {
-	s.loads = 0
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidateAll()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	s.cache.Clear()
+	if s.old != nil {
+		s.old.Clear()
+	}
 	return nil
 }
 
 // GetStats 获取统计数据
 func (s *freecacheImpl) GetStats() Stats {
-	return Stats{
-		Hits:    s.cache.HitCount(),
-		Misses:  s.cache.MissCount(),
-		HitRate: s.cache.HitRate(),
-		Loads:   s.loads,
+	var stats Stats
+	s.fillStats(&stats)
+	s.lock.RLock()
+	stats.EntryCount = s.cache.EntryCount()
+	stats.Evictions = s.cache.EvacuateCount() + s.retiredEvictions
+	stats.Expirations = s.cache.ExpiredCount() + s.retiredExpirations
+	if s.old != nil {
+		stats.EntryCount += s.old.EntryCount()
+		stats.Evictions += s.old.EvacuateCount()
+		stats.Expirations += s.old.ExpiredCount()
+	}
+	s.lock.RUnlock()
+	return stats
+}
+
+// ResetStats 重置统计数据
+func (s *freecacheImpl) ResetStats() {
+	s.stats.reset()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cache.ResetStatistics()
+	if s.old != nil {
+		s.old.ResetStatistics()
 	}
+	s.retiredEvictions, s.retiredExpirations = 0, 0
+}
+
+// Resize 以新的容量重建freecache，存量数据连同剩余过期时间在后台迁移，迁移期间正常提供读写
+func (s *freecacheImpl) Resize(newSizeInMB int) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	if newSizeInMB <= 0 {
+		return ErrInvalidConfig
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.checkClosed(); err != nil {
+		return err // 与Close并发，Close不再等待新的迁移协程
+	}
+	if s.old != nil {
+		return ErrResizing
+	}
+	size := newSizeInMB * 1024 * 1024
+	atomic.StoreInt64(&s.size, int64(size))
+	s.old, s.cache = s.cache, freecache.NewCache(size)
+	s.wg.Add(1)
+	go s.migrate(s.old)
+	return nil
+}
+
+// migrate 将旧实例的数据迁移到当前实例，当前实例已有的key以当前实例为准
+func (s *freecacheImpl) migrate(old *freecache.Cache) {
+	defer s.wg.Done()
+	iter := old.NewIterator()
+	for entry := iter.Next(); entry != nil && s.checkClosed() == nil; entry = iter.Next() {
+		var ttl int
+		if entry.ExpireAt > 0 {
+			if ttl = int(int64(entry.ExpireAt) - time.Now().Unix()); ttl <= 0 {
+				continue
+			}
+		}
+		s.lock.Lock()
+		// 迭代期间key可能已被删除或重新设置，需要再次确认
+		if _, err := old.Peek(entry.Key); err == nil {
+			if _, err := s.cache.Peek(entry.Key); err == freecache.ErrNotFound {
+				s.cache.Set(entry.Key, entry.Value, ttl)
+			}
+		}
+		s.lock.Unlock()
+	}
+	s.lock.Lock()
+	s.retiredEvictions += old.EvacuateCount()
+	s.retiredExpirations += old.ExpiredCount()
+	s.old = nil
+	s.lock.Unlock()
+	old.Clear()
+}
+
+// Capabilities 返回实例支持的可选特性
+func (s *freecacheImpl) Capabilities() Capability {
+	return CapPerKeyTTL | CapResize
+}
+
+// Close 关闭实例，等待迁移协程退出后释放内存
+func (s *freecacheImpl) Close() error {
+	if err := s.markClosed(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.lock.Unlock() // 持有锁的Resize已启动迁移协程，之后的Resize返回ErrClosed
+	s.wg.Wait()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.cache.Clear()
+	return nil
 }
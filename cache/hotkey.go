@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHotKeyCapacity = 100
+	defaultHotKeyWindow   = time.Minute
+	hotKeyBuckets         = 6 // 滚动窗口的分段数，窗口按段滚动
+)
+
+// HotKeyConfig 热key统计配置
+type HotKeyConfig struct {
+	Capacity   int           // 每个时间段最多跟踪的key数量，决定内存上限和精度，默认100
+	Window     time.Duration // 统计最近多长时间的访问，默认1分钟
+	SampleRate float64       // 采样率(0~1]，按固定间隔采样，默认1即不采样
+}
+
+// HotKey 热key及其估算的访问次数
+type HotKey struct {
+	Key   string
+	Count int64 // 估算访问次数，已按采样率放大。某个时间段内key被挤出后该段的访问不再计入，可能小于真实值
+	Error int64 // Count的最大高估量，Count-Error不大于真实值
+}
+
+// HotKeyTracker 基于Space-Saving算法统计滚动窗口内Get/GetWithLoad访问最多的key。
+// 每个时间段最多保存Capacity个key，内存占用与访问的key数量无关
+type HotKeyTracker struct {
+	lock     sync.Mutex
+	capacity int
+	width    time.Duration // 每个时间段的长度
+	every    uint64        // 每every次访问采样一次
+	seq      uint64        // 访问计数，原子读写
+	buckets  [hotKeyBuckets]hotKeyBucket
+	now      func() time.Time
+}
+
+type hotKeyBucket struct {
+	epoch   int64 // 时间段序号，即unix纳秒/width
+	summary *spaceSaving
+}
+
+// NewHotKeyTracker 构造热key统计，通过Middleware接入cache实例
+func NewHotKeyTracker(cfg HotKeyConfig) *HotKeyTracker {
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = defaultHotKeyCapacity
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultHotKeyWindow
+	}
+	every := uint64(1)
+	if cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		every = uint64(math.Round(1 / cfg.SampleRate))
+	}
+	t := &HotKeyTracker{
+		capacity: cfg.Capacity,
+		width:    cfg.Window / hotKeyBuckets,
+		every:    every,
+		now:      time.Now,
+	}
+	if t.width <= 0 {
+		t.width = 1 // Window小于hotKeyBuckets纳秒
+	}
+	for i := range t.buckets {
+		t.buckets[i].summary = newSpaceSaving(cfg.Capacity)
+	}
+	return t
+}
+
+// Middleware 返回统计Get/GetWithLoad访问key的中间件，使用方式：cache.Chain(api, tracker.Middleware())
+func (t *HotKeyTracker) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, op *Operation) error {
+			if op.Name == OpGet || op.Name == OpGetWithLoad {
+				t.Record(op.Key)
+			}
+			return next(ctx, op)
+		}
+	}
+}
+
+// Record 记录一次key访问，未被采样的访问只有一次原子操作
+func (t *HotKeyTracker) Record(key string) {
+	if t.every > 1 && atomic.AddUint64(&t.seq, 1)%t.every != 0 {
+		return
+	}
+	epoch := t.now().UnixNano() / int64(t.width)
+	t.lock.Lock()
+	b := &t.buckets[epoch%hotKeyBuckets]
+	if b.epoch != epoch {
+		b.epoch = epoch
+		b.summary.reset()
+	}
+	b.summary.add(key)
+	t.lock.Unlock()
+}
+
+// HotKeys 返回最近Window时间内访问次数最多的n个key，按Count从大到小排列
+func (t *HotKeyTracker) HotKeys(n int) []HotKey {
+	epoch := t.now().UnixNano() / int64(t.width)
+	merged := make(map[string]*HotKey)
+	t.lock.Lock()
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if b.epoch <= epoch-hotKeyBuckets || b.epoch > epoch {
+			continue
+		}
+		for _, c := range b.summary.counters {
+			hk, ok := merged[c.key]
+			if !ok {
+				hk = &HotKey{Key: c.key}
+				merged[c.key] = hk
+			}
+			hk.Count += c.count
+			hk.Error += c.error
+		}
+	}
+	t.lock.Unlock()
+
+	keys := make([]HotKey, 0, len(merged))
+	for _, hk := range merged {
+		hk.Count *= int64(t.every)
+		hk.Error *= int64(t.every)
+		keys = append(keys, *hk)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if n >= 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// spaceSaving Space-Saving top-K算法：最多保存capacity个计数器，
+// 满了之后新key替换计数最小的计数器并继承其计数，最小计数器用小顶堆维护
+type spaceSaving struct {
+	capacity int
+	counters []*ssCounter // 小顶堆
+	index    map[string]*ssCounter
+}
+
+type ssCounter struct {
+	key   string
+	count int64
+	error int64 // 继承的计数，即最大高估量
+	pos   int   // 在堆中的位置
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, index: make(map[string]*ssCounter, capacity)}
+}
+
+func (s *spaceSaving) add(key string) {
+	if c, ok := s.index[key]; ok {
+		c.count++
+		heap.Fix(s, c.pos)
+		return
+	}
+	if len(s.counters) < s.capacity {
+		heap.Push(s, &ssCounter{key: key, count: 1})
+		return
+	}
+	c := s.counters[0]
+	delete(s.index, c.key)
+	c.key, c.error = key, c.count
+	c.count++
+	s.index[key] = c
+	heap.Fix(s, 0)
+}
+
+func (s *spaceSaving) reset() {
+	s.counters = s.counters[:0]
+	s.index = make(map[string]*ssCounter, s.capacity)
+}
+
+// Len 实现heap.Interface
+func (s *spaceSaving) Len() int { return len(s.counters) }
+
+// Less 实现heap.Interface
+func (s *spaceSaving) Less(i, j int) bool { return s.counters[i].count < s.counters[j].count }
+
+// Swap 实现heap.Interface
+func (s *spaceSaving) Swap(i, j int) {
+	s.counters[i], s.counters[j] = s.counters[j], s.counters[i]
+	s.counters[i].pos, s.counters[j].pos = i, j
+}
+
+// Push 实现heap.Interface
+func (s *spaceSaving) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.pos = len(s.counters)
+	s.counters = append(s.counters, c)
+	s.index[c.key] = c
+}
+
+// Pop 实现heap.Interface
+func (s *spaceSaving) Pop() interface{} {
+	c := s.counters[len(s.counters)-1]
+	s.counters = s.counters[:len(s.counters)-1]
+	delete(s.index, c.key)
+	return c
+}
@@ -0,0 +1,97 @@
+package cache
+
+import "sync"
+
+// leaseShards 租约表的分片数，不同key的加载、回填和写入互不阻塞
+const leaseShards = 64
+
+// leases GetWithLoad回填的租约(memcached lease)：未命中开始加载时为key发放租约，
+// Set/SetWithExpire/Delete使该key的租约失效，Clear使所有租约失效，回填时租约已失效则丢弃，
+// 避免加载到的旧数据覆盖加载期间的更新或删除
+type leases struct {
+	shards [leaseShards]leaseShard
+}
+
+type leaseShard struct {
+	lock   sync.Mutex
+	seq    uint64
+	tokens map[string]uint64 // key -> 有效的租约
+}
+
+func newLeases() *leases {
+	l := &leases{}
+	for i := range l.shards {
+		l.shards[i].tokens = make(map[string]uint64)
+	}
+	return l
+}
+
+// shard 按key的FNV-1a哈希选择分片
+func (l *leases) shard(key string) *leaseShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &l.shards[h%leaseShards]
+}
+
+// acquire 为key发放新租约，之前的租约失效
+func (l *leases) acquire(key string) uint64 {
+	s := l.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	s.tokens[key] = s.seq
+	return s.seq
+}
+
+// invalidate 使key的租约失效
+func (l *leases) invalidate(key string) {
+	s := l.shard(key)
+	s.lock.Lock()
+	delete(s.tokens, key)
+	s.lock.Unlock()
+}
+
+// invalidateAll 使所有租约失效
+func (l *leases) invalidateAll() {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.lock.Lock()
+		s.tokens = make(map[string]uint64)
+		s.lock.Unlock()
+	}
+}
+
+// valid 租约是否有效，done为true时同时收回租约
+func (l *leases) valid(key string, token uint64, done bool) bool {
+	s := l.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tokens[key] != token {
+		return false
+	}
+	if done {
+		delete(s.tokens, key)
+	}
+	return true
+}
+
+// fill 租约有效时调用set回填并收回租约，返回是否回填。set不在锁内执行，写入后再次检查租约：
+// 写入期间租约失效(并发的写入、删除、清空或新的加载)时调用undo删除回填的数据并返回false，
+// 宁可丢弃并发写入的新数据产生一次未命中，也不让旧数据覆盖加载期间的更新或删除
+func (l *leases) fill(key string, token uint64, set func() error, undo func()) (bool, error) {
+	if !l.valid(key, token, false) {
+		return false, nil
+	}
+	if err := set(); err != nil {
+		l.valid(key, token, true)
+		return true, err
+	}
+	if !l.valid(key, token, true) {
+		undo()
+		return false, nil
+	}
+	return true, nil
+}
@@ -1,18 +1,45 @@
 package cache
 
 import (
+	"container/list"
 	"context"
+	"hash/crc32"
 	"reflect"
+	"sync"
+	"time"
 
 	"git.code.oa.com/trpc-go/trpc-database/localcache"
+	"git.code.oa.com/trpc-go/trpc-go/log"
 )
 
 const tenYearsInSecond = 10 * 365 * 24 * 60 * 60
 
+// CopyPolicy localcache读写value时的拷贝策略
+type CopyPolicy int
+
+// 拷贝策略定义
+const (
+	CopyNone      CopyPolicy = iota // 不拷贝，Get返回Set时的同一个对象，调用方不能修改
+	CopyClone                       // Set和Get时通过Cloner深拷贝，未实现Cloner的value通过序列化拷贝
+	CopySerialize                   // Set时序列化保存，Get时反序列化
+)
+
+// Cloner 支持深拷贝的value，Clone需要返回与自身类型相同的新对象
+type Cloner interface {
+	Clone() interface{}
+}
+
+// localEntry localcache中实际保存的数据
+type localEntry struct {
+	value    interface{} // CopySerialize时为序列化后的[]byte
+	checksum uint32      // 开启MutationCheck时value序列化后的校验和
+	meta     entryMeta
+}
+
 type localcacheImpl struct {
+	*base
 	cache localcache.Cache
-	cfg   *Config
-	stats *Stats
+	costs *costTracker
 }
 
 func init() {
@@ -24,34 +51,74 @@ func newLocalCache(cfg *Config) (API, error) {
 		// DefaultTTL为0表示不过期，但localcache又必须设置过期时间，因此取一个较大的过期时间
 		cfg.DefaultTTL = tenYearsInSecond
 	}
-	return &localcacheImpl{
-		cache: localcache.New(localcache.WithCapacity(cfg.sizeToCapacity()), localcache.WithExpiration(cfg.DefaultTTL)),
-		cfg:   cfg,
-		stats: &Stats{},
-	}, nil
+	s := &localcacheImpl{
+		base:  newBase(cfg),
+		costs: newCostTracker(int64(cfg.MaxSizeInBytes())),
+	}
+	// 内存由costTracker按字节限制，localcache的key数量上限不再生效：每个key至少占用1字节
+	s.cache = localcache.New(
+		localcache.WithCapacity(cfg.MaxSizeInBytes()),
+		localcache.WithExpiration(cfg.DefaultTTL),
+		localcache.WithOnExpire(s.onExpire),
+		localcache.WithOnDel(s.onRemove),
+	)
+	return s, nil
 }
 
 // Get 定制化Get方法，获取key, 不存在返回ErrEntryNotFound。
 func (s *localcacheImpl) Get(key string, value interface{}) error {
+	_, err := s.getEntry(key, value, false)
+	if err == errStale {
+		return ErrNotFound
+	}
+	return err
+}
+
+// getEntry 获取key及其元数据。
+func (s *localcacheImpl) getEntry(key string, value interface{}, stale bool) (entryMeta, error) {
+	if err := s.checkClosed(); err != nil {
+		return entryMeta{}, err
+	}
 	data, ok := s.cache.Get(key)
 	if !ok {
-		s.stats.atomicAddMissCount()
-		return ErrNotFound
+		s.costs.remove(key) // 可能已经过期
+		if !stale {
+			s.stats.miss()
+		}
+		return entryMeta{}, ErrNotFound
+	}
+	entry := data.(*localEntry)
+	if !stale && entry.meta.expired() {
+		s.stats.miss()
+		return entry.meta, errStale
 	}
-	s.stats.atomicAddHitCount()
-	return safeSet(value, data)
+	if s.cfg.MutationCheck {
+		if checksum, err := s.checksum(entry.value); err == nil && checksum != entry.checksum {
+			log.Errorf("localcache value of key %s mutated after set", key)
+			s.Delete(key)
+			if !stale {
+				s.stats.miss()
+			}
+			return entryMeta{}, ErrValueMutated
+		}
+	}
+	// 保存的是对象或本进程序列化的数据，不会损坏，拷贝失败是读取目标与value类型不匹配
+	if err := s.copyOut(entry.value, value); err != nil {
+		return entryMeta{}, s.mismatch(key, stale, err)
+	}
+	if !stale {
+		s.costs.touch(key)
+		s.stats.hit()
+	}
+	return entry.meta, nil
 }
 
 // GetWithLoad 返回key对应的value, 如果key不存在，使用load函数加载返回，并缓存ttl秒。
 func (s *localcacheImpl) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
-	hit, err := getWithLoad(ctx, s, key, value, load)
-	if err != nil {
+	if err := s.checkClosed(); err != nil {
 		return err
 	}
-	if !hit {
-		s.stats.atomicAddLoadCount()
-	}
-	return nil
+	return s.getWithLoad(ctx, s, key, value, load)
 }
 
 // Set 保存一对<key, value>。
@@ -59,31 +126,180 @@ func (s *localcacheImpl) Set(key string, value interface{}) error {
 	return s.SetWithExpire(key, value, s.cfg.DefaultTTL)
 }
 
-// SetWithExpire 设置key value，并制定过期时间。
+// SetWithExpire 设置key value，并制定过期时间。超出内存限制时按LRU淘汰，value本身超过限制返回ErrValueTooLarge。
 func (s *localcacheImpl) SetWithExpire(key string, value interface{}, ttl int64) error {
-	s.cache.SetWithExpire(key, value, ttl)
+	s.leases.invalidate(key)
+	return s.setEntry(key, value, s.jitter(ttl), 0)
+}
+
+// setEntry 设置key value，并保存过期时间和加载耗时。
+func (s *localcacheImpl) setEntry(key string, value interface{}, ttl int64, delta time.Duration) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	stored, err := s.copyIn(value)
+	if err != nil {
+		s.stats.serializeError()
+		return err
+	}
+	entry := &localEntry{value: stored, meta: newEntryMeta(ttl, delta)}
+	if s.cfg.MutationCheck {
+		if entry.checksum, err = s.checksum(stored); err != nil {
+			s.stats.serializeError()
+			return err
+		}
+	}
+	victims, err := s.costs.add(key, int64(len(key)+s.cfg.Sizer(value)))
+	if err != nil {
+		return err
+	}
+	for _, victim := range victims {
+		s.cache.Del(victim)
+		s.emit(EventEvict, victim, 0)
+	}
+	s.stats.evict(int64(len(victims)))
+	s.cache.SetWithExpire(key, entry, storeTTL(ttl, s.cfg.StaleTTL))
+	s.stats.set()
 	return nil
 }
 
+func (s *localcacheImpl) remove(key string) {
+	s.cache.Del(key)
+	s.costs.remove(key)
+}
+
+// MaxValueSize value按Sizer估算的大小不能超过实例的内存限制。
+func (s *localcacheImpl) MaxValueSize(key string) int {
+	return s.cfg.MaxSizeInBytes() - len(key)
+}
+
 // Delete 删除一个key。
 func (s *localcacheImpl) Delete(key string) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidate(key)
+	s.stats.delete()
 	s.cache.Del(key)
+	s.costs.remove(key)
 	return nil
 }
 
 // Clear 清空所有元素。
 func (s *localcacheImpl) Clear() error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+	s.leases.invalidateAll()
 	s.cache.Clear()
+	s.costs.clear()
 	return nil
 }
 
 // GetStats 获取统计数据。
 func (s *localcacheImpl) GetStats() Stats {
-	s.stats.HitRate = s.stats.calcHitRate() // calculate on read
-	return *s.stats
+	var stats Stats
+	s.fillStats(&stats)
+	stats.EntryCount, stats.BytesUsed = s.costs.usage()
+	return stats
+}
+
+// ResetStats 重置统计数据。
+func (s *localcacheImpl) ResetStats() {
+	s.stats.reset()
 }
 
-// safeSet 将source的值赋值给target
+// Resize 不支持运行时调整容量。
+func (s *localcacheImpl) Resize(newSizeInMB int) error {
+	return ErrNotSupported
+}
+
+// Capabilities 返回实例支持的可选特性。
+func (s *localcacheImpl) Capabilities() Capability {
+	return CapPerKeyTTL | CapBytesUsed
+}
+
+// Close 关闭实例，停止localcache后台过期协程。
+func (s *localcacheImpl) Close() error {
+	if err := s.markClosed(); err != nil {
+		return err
+	}
+	s.cache.Close()
+	return nil
+}
+
+// onRemove key被删除时，释放其占用的字节数。
+func (s *localcacheImpl) onRemove(item *localcache.Item) {
+	s.costs.remove(item.Key)
+}
+
+// onExpire key过期时，释放其占用的字节数。
+func (s *localcacheImpl) onExpire(item *localcache.Item) {
+	s.stats.expire(1)
+	s.costs.remove(item.Key)
+	s.emit(EventExpire, item.Key, 0)
+}
+
+// copyIn 按拷贝策略将Set传入的value转换为实际保存的数据。
+func (s *localcacheImpl) copyIn(value interface{}) (interface{}, error) {
+	switch s.cfg.CopyPolicy {
+	case CopyClone:
+		return s.clone(value)
+	case CopySerialize:
+		return s.cfg.Serializer.Marshal(value)
+	default:
+		return value, nil
+	}
+}
+
+// copyOut 按拷贝策略将保存的数据赋值给Get传入的target。
+func (s *localcacheImpl) copyOut(stored, target interface{}) error {
+	switch s.cfg.CopyPolicy {
+	case CopyClone:
+		cloned, err := s.clone(stored)
+		if err != nil {
+			return err
+		}
+		return safeSet(target, cloned)
+	case CopySerialize:
+		return s.cfg.Serializer.Unmarshal(stored.([]byte), target)
+	default:
+		return safeSet(target, stored)
+	}
+}
+
+// clone 深拷贝value，优先使用Cloner，否则序列化后再反序列化到同类型的新对象。
+func (s *localcacheImpl) clone(value interface{}) (interface{}, error) {
+	if cloner, ok := value.(Cloner); ok {
+		return cloner.Clone(), nil
+	}
+	if value == nil {
+		return nil, nil
+	}
+	data, err := s.cfg.Serializer.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	cloned := reflect.New(reflect.TypeOf(value))
+	if err := s.cfg.Serializer.Unmarshal(data, cloned.Interface()); err != nil {
+		return nil, err
+	}
+	return cloned.Elem().Interface(), nil
+}
+
+// checksum 计算保存数据的校验和。
+func (s *localcacheImpl) checksum(stored interface{}) (uint32, error) {
+	data, ok := stored.([]byte)
+	if !ok || s.cfg.CopyPolicy != CopySerialize {
+		var err error
+		if data, err = s.cfg.Serializer.Marshal(stored); err != nil {
+			return 0, err
+		}
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
+// safeSet 将source的值赋值给target，source是指向target同类型数据的指针时赋值其指向的数据
 func safeSet(target, source interface{}) error {
 	value := reflect.ValueOf(target)
 	kind := value.Kind()
@@ -94,6 +310,163 @@ func safeSet(target, source interface{}) error {
 	if !elem.CanSet() {
 		return ErrCannotSet
 	}
-	elem.Set(reflect.ValueOf(source))
+	src := reflect.ValueOf(source)
+	if !src.IsValid() {
+		elem.Set(reflect.Zero(elem.Type()))
+		return nil
+	}
+	if src.Kind() == reflect.Ptr && !src.IsNil() && !src.Type().AssignableTo(elem.Type()) {
+		src = src.Elem()
+	}
+	if !src.Type().AssignableTo(elem.Type()) {
+		return ErrCannotSet
+	}
+	elem.Set(src)
 	return nil
 }
+
+// costTracker 按字节数记录每个key的占用，超出预算时按LRU选出需要淘汰的key
+type costTracker struct {
+	lock    sync.Mutex
+	budget  int64
+	used    int64
+	order   *list.List // 队头为最近使用
+	entries map[string]*list.Element
+}
+
+type costEntry struct {
+	key  string
+	cost int64
+}
+
+func newCostTracker(budget int64) *costTracker {
+	return &costTracker{budget: budget, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// add 记录key的占用，返回为腾出空间需要淘汰的key。调用方负责删除，避免持锁回调。
+func (t *costTracker) add(key string, cost int64) ([]string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if cost > t.budget {
+		return nil, ErrValueTooLarge
+	}
+	if elem, ok := t.entries[key]; ok {
+		t.used -= elem.Value.(*costEntry).cost
+		t.order.Remove(elem)
+	}
+	victims := t.shrink(t.budget - cost)
+	t.entries[key] = t.order.PushFront(&costEntry{key: key, cost: cost})
+	t.used += cost
+	return victims, nil
+}
+
+// fits cost是否不超过预算
+func (t *costTracker) fits(cost int64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return cost <= t.budget
+}
+
+// tryAdd 同add，但超出预算时不淘汰，返回false
+func (t *costTracker) tryAdd(key string, cost int64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	used := t.used
+	if elem, ok := t.entries[key]; ok {
+		used -= elem.Value.(*costEntry).cost
+	}
+	if used+cost > t.budget {
+		return false
+	}
+	if elem, ok := t.entries[key]; ok {
+		t.order.Remove(elem)
+	}
+	t.entries[key] = t.order.PushFront(&costEntry{key: key, cost: cost})
+	t.used = used + cost
+	return true
+}
+
+// setBudget 调整预算，返回超出新预算需要淘汰的key
+func (t *costTracker) setBudget(budget int64) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.budget = budget
+	return t.shrink(budget)
+}
+
+// shrink 按LRU淘汰直到占用不超过limit，需持有锁
+func (t *costTracker) shrink(limit int64) []string {
+	var victims []string
+	for t.used > limit {
+		entry := t.order.Remove(t.order.Back()).(*costEntry)
+		delete(t.entries, entry.key)
+		t.used -= entry.cost
+		victims = append(victims, entry.key)
+	}
+	return victims
+}
+
+// extract 移出match为true的key，按从最久未使用到最近使用的顺序返回
+func (t *costTracker) extract(match func(key string) bool) []costEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var entries []costEntry
+	for elem := t.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if entry := elem.Value.(*costEntry); match(entry.key) {
+			entries = append(entries, *entry)
+			t.order.Remove(elem)
+			delete(t.entries, entry.key)
+			t.used -= entry.cost
+		}
+		elem = prev
+	}
+	return entries
+}
+
+// adopt 记录从其他costTracker移入的key，已记录的key以现有记录为准，返回超出预算需要淘汰的key
+func (t *costTracker) adopt(entries []costEntry) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := range entries {
+		if _, ok := t.entries[entries[i].key]; ok {
+			continue
+		}
+		entry := entries[i]
+		t.entries[entry.key] = t.order.PushFront(&entry)
+		t.used += entry.cost
+	}
+	return t.shrink(t.budget)
+}
+
+func (t *costTracker) touch(key string) {
+	t.lock.Lock()
+	if elem, ok := t.entries[key]; ok {
+		t.order.MoveToFront(elem)
+	}
+	t.lock.Unlock()
+}
+
+func (t *costTracker) remove(key string) {
+	t.lock.Lock()
+	if elem, ok := t.entries[key]; ok {
+		t.used -= t.order.Remove(elem).(*costEntry).cost
+		delete(t.entries, key)
+	}
+	t.lock.Unlock()
+}
+
+func (t *costTracker) clear() {
+	t.lock.Lock()
+	t.used = 0
+	t.order.Init()
+	t.entries = make(map[string]*list.Element)
+	t.lock.Unlock()
+}
+
+// usage 返回当前key数量和占用字节数
+func (t *costTracker) usage() (count int64, bytes int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return int64(len(t.entries)), t.used
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"git.code.oa.com/trpc-go/trpc-go/log"
+)
+
+// 中间件拦截的操作名
+const (
+	OpGet           = "Get"
+	OpGetWithLoad   = "GetWithLoad"
+	OpSet           = "Set"
+	OpSetWithExpire = "SetWithExpire"
+	OpDelete        = "Delete"
+	OpClear         = "Clear"
+)
+
+// Operation 中间件拦截的一次cache操作
+type Operation struct {
+	Name  string      // 操作名，OpGet等
+	Key   string      // Clear时为空
+	Value interface{} // Get/GetWithLoad时为接收结果的指针，Set/SetWithExpire时为写入的值
+	TTL   int64       // 仅SetWithExpire有效，单位秒
+	Load  LoadFunc    // 仅GetWithLoad有效
+}
+
+// Handler 处理一次cache操作
+type Handler func(ctx context.Context, op *Operation) error
+
+// Middleware cache操作中间件，在next前后添加逻辑，也可以不调用next直接返回
+type Middleware func(next Handler) Handler
+
+// chained Chain返回的cache实例，数据操作经过中间件，其余接口直接调用被包装的实例
+type chained struct {
+	API
+	handler Handler
+}
+
+// Chain 使用中间件包装cache实例，第一个中间件在最外层。
+// Get/GetWithLoad/Set/SetWithExpire/Delete/Clear经过中间件，Get/Set等没有ctx的操作使用context.Background()
+func Chain(api API, middlewares ...Middleware) API {
+	c := &chained{API: api}
+	c.handler = c.invoke
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		c.handler = middlewares[i](c.handler)
+	}
+	return c
+}
+
+// Unwrap 返回被包装的cache实例
+func (c *chained) Unwrap() API {
+	return c.API
+}
+
+// LoadDurationHistogram 返回被包装实例的自动加载耗时直方图，未实现LoadHistogram时返回空直方图
+func (c *chained) LoadDurationHistogram() HistogramSnapshot {
+	if h, ok := c.API.(LoadHistogram); ok {
+		return h.LoadDurationHistogram()
+	}
+	return HistogramSnapshot{}
+}
+
+// invoke 调用被包装实例，位于中间件链的最内层
+func (c *chained) invoke(ctx context.Context, op *Operation) error {
+	switch op.Name {
+	case OpGet:
+		return c.API.Get(op.Key, op.Value)
+	case OpGetWithLoad:
+		return c.API.GetWithLoad(ctx, op.Key, op.Value, op.Load)
+	case OpSet:
+		return c.API.Set(op.Key, op.Value)
+	case OpSetWithExpire:
+		return c.API.SetWithExpire(op.Key, op.Value, op.TTL)
+	case OpDelete:
+		return c.API.Delete(op.Key)
+	case OpClear:
+		return c.API.Clear()
+	default:
+		return ErrNotSupported
+	}
+}
+
+// Get 获取key
+func (c *chained) Get(key string, value interface{}) error {
+	return c.handler(context.Background(), &Operation{Name: OpGet, Key: key, Value: value})
+}
+
+// GetWithLoad 返回key对应的value, 如果key不存在，使用load函数加载返回
+func (c *chained) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
+	return c.handler(ctx, &Operation{Name: OpGetWithLoad, Key: key, Value: value, Load: load})
+}
+
+// Set 保存一对<key, value>
+func (c *chained) Set(key string, value interface{}) error {
+	return c.handler(context.Background(), &Operation{Name: OpSet, Key: key, Value: value})
+}
+
+// SetWithExpire 设置key value，并指定过期时间
+func (c *chained) SetWithExpire(key string, value interface{}, ttl int64) error {
+	return c.handler(context.Background(), &Operation{Name: OpSetWithExpire, Key: key, Value: value, TTL: ttl})
+}
+
+// Delete 删除一个key
+func (c *chained) Delete(key string) error {
+	return c.handler(context.Background(), &Operation{Name: OpDelete, Key: key})
+}
+
+// Clear 清空所有元素
+func (c *chained) Clear() error {
+	return c.handler(context.Background(), &Operation{Name: OpClear})
+}
+
+// LoggingMiddleware 结构化记录每次操作的op、key、ttl、耗时和结果，失败记Error日志(ErrNotFound除外)，其余记Debug日志
+func LoggingMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, op *Operation) error {
+			start := time.Now()
+			err := next(ctx, op)
+			logger := opLogger(op, time.Since(start), err)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				logger.Errorf("cache %s failed", op.Name)
+			} else {
+				logger.Debugf("cache %s", op.Name)
+			}
+			return err
+		}
+	}
+}
+
+// SlowOpMiddleware 耗时超过threshold的操作记Warn日志，GetWithLoad的耗时包含LoadFunc
+func SlowOpMiddleware(threshold time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, op *Operation) error {
+			start := time.Now()
+			err := next(ctx, op)
+			if cost := time.Since(start); cost > threshold {
+				opLogger(op, cost, err).Warnf("cache %s slow, threshold %v", op.Name, threshold)
+			}
+			return err
+		}
+	}
+}
+
+// KeyLengthMiddleware key长度超过maxLen字节时不调用引擎，直接返回ErrKeyTooLong
+func KeyLengthMiddleware(maxLen int) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, op *Operation) error {
+			if len(op.Key) > maxLen {
+				return ErrKeyTooLong
+			}
+			return next(ctx, op)
+		}
+	}
+}
+
+func opLogger(op *Operation, cost time.Duration, err error) log.Logger {
+	fields := []string{"op", op.Name, "key", op.Key, "cost", cost.String()}
+	if op.Name == OpSetWithExpire {
+		fields = append(fields, "ttl", strconv.FormatInt(op.TTL, 10))
+	}
+	if err != nil {
+		fields = append(fields, "error", err.Error())
+	}
+	return log.WithFields(fields...)
+}
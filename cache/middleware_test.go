@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	inner, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	var trace []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, op *Operation) error {
+				trace = append(trace, name+":"+op.Name+":"+op.Key)
+				return next(ctx, op)
+			}
+		}
+	}
+	cache := Chain(inner, record("outer"), record("inner"))
+	assert.Nil(t, cache.SetWithExpire(keyString, "value", 10))
+	var value string
+	assert.Nil(t, cache.Get(keyString, &value))
+	assert.Equal(t, "value", value)
+	assert.Nil(t, cache.Delete(keyString))
+	assert.Nil(t, cache.Clear())
+	assert.Equal(t, []string{
+		"outer:SetWithExpire:" + keyString, "inner:SetWithExpire:" + keyString,
+		"outer:Get:" + keyString, "inner:Get:" + keyString,
+		"outer:Delete:" + keyString, "inner:Delete:" + keyString,
+		"outer:Clear:", "inner:Clear:",
+	}, trace)
+
+	// GetWithLoad内部的Get/Set不经过中间件
+	trace = nil
+	assert.Nil(t, testLoad(cache, keyNumber))
+	assert.Equal(t, []string{"outer:GetWithLoad:" + keyNumber, "inner:GetWithLoad:" + keyNumber}, trace)
+	assert.Equal(t, int64(1), cache.GetStats().Loads)
+	assert.Equal(t, inner, cache.(interface{ Unwrap() API }).Unwrap())
+	assert.Equal(t, int64(1), sumCounts(cache.(LoadHistogram).LoadDurationHistogram().Counts))
+
+	// 中间件可以拦截操作、改写结果
+	fault := errors.New("injected")
+	cache = Chain(inner, func(next Handler) Handler {
+		return func(ctx context.Context, op *Operation) error {
+			if op.Name == OpSet {
+				return fault
+			}
+			return next(ctx, op)
+		}
+	})
+	assert.Equal(t, fault, cache.Set(keyString, "value"))
+	assert.Equal(t, ErrNotFound, cache.Get(keyString, &value))
+}
+
+func TestBuiltinMiddlewares(t *testing.T) {
+	inner, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	cache := Chain(inner, LoggingMiddleware(), SlowOpMiddleware(time.Nanosecond), KeyLengthMiddleware(4))
+	assert.Equal(t, ErrKeyTooLong, cache.Set("12345", 1))
+	assert.Nil(t, cache.Set("1234", 1))
+	var value int
+	assert.Nil(t, cache.Get("1234", &value))
+	assert.Equal(t, 1, value)
+	assert.Equal(t, ErrNotFound, cache.Get("abc", &value))
+	assert.Equal(t, int64(1), cache.GetStats().Sets)
+}
+
+func testLoad(cache API, key string) error {
+	var value int
+	return cache.GetWithLoad(context.Background(), key, &value, func(ctx context.Context, key string,
+		value interface{}) (int64, error) {
+		*value.(*int) = 1
+		return 0, nil
+	})
+}
+
+func sumCounts(counts []int64) int64 {
+	var sum int64
+	for _, count := range counts {
+		sum += count
+	}
+	return sum
+}
+
+func TestHotKeyTracker(t *testing.T) {
+	tracker := NewHotKeyTracker(HotKeyConfig{Capacity: 10, Window: 6 * time.Second})
+	now := time.Unix(1000, 0)
+	tracker.now = func() time.Time { return now }
+
+	inner, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	cache := Chain(inner, tracker.Middleware())
+	var value int
+	for i := 0; i < 100; i++ {
+		cache.Get("hot", &value)
+		if i%2 == 0 {
+			cache.Get("warm", &value)
+		}
+		cache.Set("hot", i) // Set不计入
+		cache.Get(fmt.Sprintf("cold%d", i), &value)
+	}
+	assert.Nil(t, testLoad(cache, "hot"))
+	hot := tracker.HotKeys(2)
+	assert.Equal(t, 2, len(hot))
+	assert.Equal(t, "hot", hot[0].Key)
+	assert.True(t, hot[0].Count-hot[0].Error <= 101 && hot[0].Count >= 101)
+	assert.Equal(t, "warm", hot[1].Key)
+	assert.True(t, hot[1].Count-hot[1].Error <= 50 && hot[1].Count >= 50)
+
+	// 窗口滚动后旧的访问不再计入
+	now = now.Add(3 * time.Second)
+	tracker.Record("new")
+	assert.Equal(t, "hot", tracker.HotKeys(1)[0].Key)
+	now = now.Add(4 * time.Second)
+	assert.Equal(t, []HotKey{{Key: "new", Count: 1}}, tracker.HotKeys(10))
+}
+
+func TestHotKeySampling(t *testing.T) {
+	tracker := NewHotKeyTracker(HotKeyConfig{SampleRate: 0.1})
+	for i := 0; i < 1000; i++ {
+		tracker.Record("a")
+	}
+	assert.Equal(t, []HotKey{{Key: "a", Count: 1000}}, tracker.HotKeys(1))
+
+	// 窗口小于分段数纳秒时按1纳秒分段
+	tracker = NewHotKeyTracker(HotKeyConfig{Window: time.Nanosecond})
+	assert.NotPanics(t, func() {
+		tracker.Record("a")
+		tracker.HotKeys(1)
+	})
+}
@@ -0,0 +1,314 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// 超大value相关的key后缀，key中不应包含'\x00'
+const (
+	overflowManifestSuffix = "\x00overflow"
+	overflowChunkSuffix    = "\x00chunk\x00"
+)
+
+// OverflowPolicy value超过实例大小上限时的处理方式
+type OverflowPolicy int
+
+// 超大value的处理方式
+const (
+	OverflowReject    OverflowPolicy = iota // 返回ErrValueTooLarge，与不包装时相同
+	OverflowCompress                        // 序列化并压缩后保存，压缩后仍超过上限时返回ErrValueTooLarge
+	OverflowChunk                           // 序列化后拆分保存到多个key，读取时校验完整性
+	OverflowSecondary                       // 保存到Secondary实例
+)
+
+// OverflowConfig 超大value处理配置，不同引擎的处理结果一致
+type OverflowConfig struct {
+	Policy     OverflowPolicy
+	Serializer Serializer // OverflowCompress/OverflowChunk的序列化实例，默认json
+	Compressor Compressor // OverflowCompress的压缩实例，默认gzip
+	Secondary  API        // OverflowSecondary的二级实例，如容量更大的实例或外部存储
+}
+
+// overflowManifest 超大value的描述，保存在key+overflowManifestSuffix下
+type overflowManifest struct {
+	Policy OverflowPolicy `json:"p"`
+	Data   []byte         `json:"d,omitempty"` // OverflowCompress：压缩后的数据
+	Chunks int            `json:"c,omitempty"` // OverflowChunk：分片数
+	Size   int            `json:"s,omitempty"` // OverflowChunk：序列化后的总大小
+	Sum    uint32         `json:"h,omitempty"` // OverflowChunk：序列化后数据的crc32
+}
+
+// overflowCache 按OverflowConfig处理超大value的cache实例
+type overflowCache struct {
+	API
+	cfg    OverflowConfig
+	large  sync.Map // 按超大value保存过的key，避免每次未命中都查询manifest
+	leases *leases  // GetWithLoad按超大value回填的租约，加载期间经本实例的写入或删除使其失效
+}
+
+// WithOverflow 包装cache实例，Set/SetWithExpire/GetWithLoad回填的value超过实例大小上限(见MaxValueSize)时按cfg.Policy处理，
+// Get/GetWithLoad透明读取。只有本实例写入的超大value可以被读取，多个进程共享外部存储时需各自包装
+func WithOverflow(api API, cfg OverflowConfig) API {
+	if cfg.Serializer == nil {
+		cfg.Serializer = jsoniter.ConfigCompatibleWithStandardLibrary
+	}
+	if cfg.Compressor == nil {
+		cfg.Compressor = GetCompressor(CompressionGzip)
+	}
+	if cfg.Policy == OverflowSecondary && cfg.Secondary == nil {
+		cfg.Policy = OverflowReject
+	}
+	return &overflowCache{API: api, cfg: cfg, leases: newLeases()}
+}
+
+// Unwrap 返回被包装的cache实例
+func (c *overflowCache) Unwrap() API {
+	return c.API
+}
+
+// LoadDurationHistogram 返回被包装实例的自动加载耗时直方图，未实现LoadHistogram时返回空直方图
+func (c *overflowCache) LoadDurationHistogram() HistogramSnapshot {
+	if h, ok := c.API.(LoadHistogram); ok {
+		return h.LoadDurationHistogram()
+	}
+	return HistogramSnapshot{}
+}
+
+// Get 获取key，未命中时读取按超大value保存的数据
+func (c *overflowCache) Get(key string, value interface{}) error {
+	err := c.API.Get(key, value)
+	if err != ErrNotFound {
+		return err
+	}
+	if _, ok := c.large.Load(key); !ok {
+		return err
+	}
+	return c.getLarge(key, value)
+}
+
+// GetWithLoad 返回key对应的value，不存在时加载；加载结果超过大小上限时按cfg.Policy保存
+func (c *overflowCache) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
+	if _, ok := c.large.Load(key); ok {
+		if err := c.getLarge(key, value); err == nil {
+			return nil
+		}
+	}
+	if c.cfg.Policy == OverflowReject {
+		return c.API.GetWithLoad(ctx, key, value, load)
+	}
+	// 引擎因超过大小上限回填失败时，在执行加载的协程中按超大value回填，回填结果传给外层包装；
+	// 租约在LoadFunc开始时发放，与回填回调在同一个协程中读写
+	var token uint64
+	ctx = withLoadHooks(ctx, loadHooks{fill: func(loaded interface{}, ttl int64, err error) error {
+		if !errors.Is(err, ErrValueTooLarge) {
+			return err
+		}
+		filled, werr := c.leases.fill(key, token, func() error {
+			return c.write(key, loaded, func(api API, key string, value interface{}) error {
+				if ttl > 0 {
+					return api.SetWithExpire(key, value, ttl)
+				}
+				return api.Set(key, value)
+			})
+		}, func() {
+			c.API.Delete(key)
+			if _, ok := c.large.Load(key); ok {
+				c.deleteLarge(key)
+			}
+		})
+		if !filled {
+			return err // 加载期间key被更新或删除，没有回填
+		}
+		return werr
+	}})
+	return c.API.GetWithLoad(ctx, key, value, func(ctx context.Context, key string, value interface{}) (int64, error) {
+		token = c.leases.acquire(key)
+		return load(ctx, key, value)
+	})
+}
+
+// Set 保存一对<key, value>
+func (c *overflowCache) Set(key string, value interface{}) error {
+	c.leases.invalidate(key)
+	return c.write(key, value, func(api API, key string, value interface{}) error {
+		return api.Set(key, value)
+	})
+}
+
+// SetWithExpire 设置key value，并指定过期时间
+func (c *overflowCache) SetWithExpire(key string, value interface{}, ttl int64) error {
+	c.leases.invalidate(key)
+	return c.write(key, value, func(api API, key string, value interface{}) error {
+		return api.SetWithExpire(key, value, ttl)
+	})
+}
+
+// Delete 删除一个key，包括按超大value保存的数据
+func (c *overflowCache) Delete(key string) error {
+	c.leases.invalidate(key)
+	err := c.API.Delete(key)
+	if _, ok := c.large.Load(key); ok && err != ErrClosed {
+		c.deleteLarge(key)
+		return nil // 超大value不在key下，引擎可能返回key不存在
+	}
+	return err
+}
+
+// Clear 清空实例，Secondary中由本实例写入的key也会被删除
+func (c *overflowCache) Clear() error {
+	c.leases.invalidateAll()
+	c.large.Range(func(key, _ interface{}) bool {
+		c.deleteLarge(key.(string))
+		return true
+	})
+	return c.API.Clear()
+}
+
+// write 先按原样写入，超过大小上限时按cfg.Policy处理
+func (c *overflowCache) write(key string, value interface{}, set func(api API, key string, value interface{}) error) error {
+	err := set(c.API, key, value)
+	if err == nil {
+		if _, ok := c.large.Load(key); ok {
+			c.deleteLarge(key) // 旧的超大value已被覆盖
+		}
+		return nil
+	}
+	if !errors.Is(err, ErrValueTooLarge) || c.cfg.Policy == OverflowReject {
+		return err
+	}
+
+	manifest := overflowManifest{Policy: c.cfg.Policy}
+	switch c.cfg.Policy {
+	case OverflowSecondary:
+		if err := set(c.cfg.Secondary, key, value); err != nil {
+			return err
+		}
+	case OverflowCompress:
+		data, err := c.cfg.Serializer.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if manifest.Data, err = c.cfg.Compressor.Compress(data); err != nil {
+			return err
+		}
+	case OverflowChunk:
+		data, err := c.cfg.Serializer.Marshal(value)
+		if err != nil {
+			return err
+		}
+		size := c.chunkSize(key)
+		if size <= 0 {
+			return ErrValueTooLarge
+		}
+		manifest.Size, manifest.Sum = len(data), crc32.ChecksumIEEE(data)
+		for off := 0; off < len(data); {
+			end := off + size
+			if end > len(data) {
+				end = len(data)
+			}
+			err := set(c.API, chunkKey(key, manifest.Chunks), data[off:end])
+			if errors.Is(err, ErrValueTooLarge) && end-off > 1 {
+				// 引擎的序列化膨胀超过预留，分片编码后仍超过大小上限，缩小分片重新写入
+				size = (end - off) / 2
+				continue
+			}
+			if err != nil {
+				c.deleteChunks(key, manifest.Chunks)
+				return err
+			}
+			manifest.Chunks++
+			off = end
+		}
+	}
+	if err := set(c.API, key+overflowManifestSuffix, manifest); err != nil {
+		c.deleteParts(key, manifest)
+		return err
+	}
+	c.large.Store(key, struct{}{})
+	c.API.Delete(key) // 删除较小的旧value，避免读到旧数据
+	return nil
+}
+
+// getLarge 读取按超大value保存的数据，数据不完整时删除并返回ErrNotFound
+func (c *overflowCache) getLarge(key string, value interface{}) error {
+	var manifest overflowManifest
+	if err := c.API.Get(key+overflowManifestSuffix, &manifest); err != nil {
+		if err == ErrNotFound {
+			c.large.Delete(key)
+		}
+		return err
+	}
+	switch manifest.Policy {
+	case OverflowSecondary:
+		return c.cfg.Secondary.Get(key, value)
+	case OverflowCompress:
+		data, err := c.cfg.Compressor.Decompress(manifest.Data)
+		if err != nil {
+			return err
+		}
+		return c.cfg.Serializer.Unmarshal(data, value)
+	case OverflowChunk:
+		data := make([]byte, 0, manifest.Size)
+		for i := 0; i < manifest.Chunks; i++ {
+			var chunk []byte
+			if err := c.API.Get(chunkKey(key, i), &chunk); err != nil {
+				c.deleteLarge(key) // 部分分片已被淘汰或过期
+				return ErrNotFound
+			}
+			data = append(data, chunk...)
+		}
+		if len(data) != manifest.Size || crc32.ChecksumIEEE(data) != manifest.Sum {
+			c.deleteLarge(key)
+			return ErrNotFound
+		}
+		return c.cfg.Serializer.Unmarshal(data, value)
+	}
+	return ErrNotFound
+}
+
+// deleteLarge 删除按超大value保存的数据
+func (c *overflowCache) deleteLarge(key string) {
+	var manifest overflowManifest
+	if err := c.API.Get(key+overflowManifestSuffix, &manifest); err == nil {
+		c.deleteParts(key, manifest)
+	} else if c.cfg.Policy == OverflowSecondary {
+		c.cfg.Secondary.Delete(key) // manifest已被淘汰，二级实例中可能还有数据
+	}
+	c.API.Delete(key + overflowManifestSuffix)
+	c.large.Delete(key)
+}
+
+func (c *overflowCache) deleteParts(key string, manifest overflowManifest) {
+	switch manifest.Policy {
+	case OverflowSecondary:
+		c.cfg.Secondary.Delete(key)
+	case OverflowChunk:
+		c.deleteChunks(key, manifest.Chunks)
+	}
+}
+
+func (c *overflowCache) deleteChunks(key string, n int) {
+	for i := 0; i < n; i++ {
+		c.API.Delete(chunkKey(key, i))
+	}
+}
+
+// chunkSize 单个分片的初始字节数。分片以[]byte保存，按json序列化为base64的4/3膨胀预留，
+// 引擎使用其他序列化方式膨胀更多时，写入返回ErrValueTooLarge后再缩小
+func (c *overflowCache) chunkSize(key string) int {
+	limit, ok := MaxValueSize(c.API, chunkKey(key, 1<<20))
+	if !ok {
+		return 0
+	}
+	return (limit-2)/4*3 - 3
+}
+
+func chunkKey(key string, i int) string {
+	return key + overflowChunkSuffix + strconv.Itoa(i)
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueTooLarge(t *testing.T) {
+	for _, engine := range []string{EngineBigCache, EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1)
+		assert.Nil(t, err, engine)
+		limit, ok := MaxValueSize(Chain(cache), "k")
+		assert.True(t, ok, engine)
+		assert.Greater(t, limit, 0, engine)
+		assert.Equal(t, ErrValueTooLarge, cache.Set("k", strings.Repeat("a", limit+1)), engine)
+		assert.Nil(t, cache.Set("k", strings.Repeat("a", limit/2)), engine)
+		// 回填超过上限时不缓存，调用方仍拿到结果
+		var value string
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "big", &value, bigLoad(limit+1)), engine)
+		assert.Equal(t, limit+1, len(value), engine)
+		assert.Equal(t, ErrNotFound, cache.Get("big", &value), engine)
+		CloseInstance(cache)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	secondary, err := New(EngineLocalCache, 10)
+	assert.Nil(t, err)
+	for _, engine := range []string{EngineBigCache, EngineFreeCache, EngineFastCache} {
+		for _, policy := range []OverflowPolicy{OverflowCompress, OverflowChunk, OverflowSecondary} {
+			api, err := New(engine, 1)
+			assert.Nil(t, err, engine)
+			cache := WithOverflow(api, OverflowConfig{Policy: policy, Secondary: secondary})
+			limit, _ := MaxValueSize(cache, "k")
+			big := strings.Repeat("a", limit*3)
+			if policy == OverflowChunk {
+				big = randomString(limit * 3) // 不可压缩
+			}
+
+			assert.Nil(t, cache.Set("k", "small"), engine, policy)
+			assert.Nil(t, cache.Set("k", big), engine, policy)
+			var value string
+			assert.Nil(t, cache.Get("k", &value), engine, policy)
+			assert.Equal(t, big, value, engine, policy)
+			// 覆盖为普通value后清理超大value
+			assert.Nil(t, cache.Set("k", "small"), engine, policy)
+			assert.Nil(t, cache.Get("k", &value), engine, policy)
+			assert.Equal(t, "small", value, engine, policy)
+			assert.Nil(t, cache.Set("k", big), engine, policy)
+			assert.Nil(t, cache.Delete("k"), engine, policy)
+			assert.Equal(t, ErrNotFound, cache.Get("k", &value), engine, policy)
+
+			// 回填超大value
+			load := bigLoad(limit * 3)
+			assert.Nil(t, cache.GetWithLoad(context.Background(), "l", &value, load), engine, policy)
+			value = ""
+			assert.Nil(t, cache.Get("l", &value), engine, policy)
+			assert.Equal(t, limit*3, len(value), engine, policy)
+			assert.Nil(t, cache.Clear(), engine, policy)
+			assert.Equal(t, ErrNotFound, cache.Get("l", &value), engine, policy)
+			// 加载期间删除key时不按超大value回填
+			deleted := func(ctx context.Context, key string, value interface{}) (int64, error) {
+				cache.Delete(key)
+				return load(ctx, key, value)
+			}
+			assert.Nil(t, cache.GetWithLoad(context.Background(), "l", &value, deleted), engine, policy)
+			assert.Equal(t, limit*3, len(value), engine, policy)
+			assert.Equal(t, ErrNotFound, cache.Get("l", &value), engine, policy)
+			CloseInstance(api)
+		}
+	}
+
+	// 分片丢失时视为未命中
+	api, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	cache := WithOverflow(api, OverflowConfig{Policy: OverflowChunk})
+	limit, _ := MaxValueSize(cache, "k")
+	assert.Nil(t, cache.Set("k", randomString(limit*3)))
+	assert.Nil(t, api.Delete(chunkKey("k", 1)))
+	var value string
+	assert.Equal(t, ErrNotFound, cache.Get("k", &value))
+	assert.Equal(t, ErrNotFound, api.Get("k"+overflowManifestSuffix, &value))
+
+	// 默认仍返回ErrValueTooLarge
+	cache = WithOverflow(api, OverflowConfig{})
+	assert.Equal(t, ErrValueTooLarge, cache.Set("k", randomString(limit*3)))
+
+	// 引擎的序列化膨胀超过json预留时，分片缩小后重新写入
+	api, err = New(EngineFastCache, 1, WithSerializer(hexSerializer{jsoniter.ConfigCompatibleWithStandardLibrary}))
+	assert.Nil(t, err)
+	cache = WithOverflow(api, OverflowConfig{Policy: OverflowChunk})
+	limit, _ = MaxValueSize(cache, "k")
+	big := randomString(limit * 3)
+	assert.Nil(t, cache.Set("k", big))
+	value = ""
+	assert.Nil(t, cache.Get("k", &value))
+	assert.Equal(t, big, value)
+}
+
+// hexSerializer []byte编码为十六进制，膨胀为2倍
+type hexSerializer struct {
+	Serializer
+}
+
+func (s hexSerializer) Marshal(body interface{}) ([]byte, error) {
+	if b, ok := body.([]byte); ok {
+		return []byte(hex.EncodeToString(b)), nil
+	}
+	return s.Serializer.Marshal(body)
+}
+
+func (s hexSerializer) Unmarshal(in []byte, body interface{}) error {
+	if b, ok := body.(*[]byte); ok {
+		var err error
+		*b, err = hex.DecodeString(string(in))
+		return err
+	}
+	return s.Serializer.Unmarshal(in, body)
+}
+
+func bigLoad(n int) LoadFunc {
+	return func(ctx context.Context, key string, value interface{}) (int64, error) {
+		*value.(*string) = strings.Repeat("b", n)
+		return 0, nil
+	}
+}
+
+func randomString(n int) string {
+	data := make([]byte, n/2+1)
+	rand.New(rand.NewSource(1)).Read(data)
+	return hex.EncodeToString(data)[:n]
+}
@@ -0,0 +1,291 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultTenant 没有单独配额的租户共用的分区名
+const DefaultTenant = "default"
+
+// QuotaPolicy 租户写入超出配额时的处理方式
+type QuotaPolicy int
+
+// 超出配额的处理方式
+const (
+	QuotaEvict  QuotaPolicy = iota // 按LRU淘汰该租户的key，不影响其他租户
+	QuotaReject                    // Set/SetWithExpire返回ErrQuotaExceeded，GetWithLoad回填仍按LRU淘汰
+)
+
+// PartitionConfig 多租户分区配置
+type PartitionConfig struct {
+	// Tenant 从key解析租户，默认取第一个':'之前的部分，没有':'时为DefaultTenant
+	Tenant func(key string) string
+	Quotas map[string]int // 租户 -> 配额，单位MB，各租户配额之和不应超过实例的MaxSizeInMB
+	// DefaultQuotaMB 不在Quotas中的租户共用的配额，单位MB，0代表不限制
+	DefaultQuotaMB int
+	Policy         QuotaPolicy
+	Sizer          Sizer // value大小估算函数，为空时通过反射估算
+}
+
+// Partitioned 多租户分区cache：所有租户共用一个cache实例，按字节记录每个租户的占用，
+// 超出配额时只淘汰该租户最久未使用的key，避免一个租户挤占其他租户。
+// 占用按Sizer估算，引擎自身淘汰或过期的key在下次Get未命中时才从占用中扣除
+type Partitioned struct {
+	API
+	cfg     PartitionConfig
+	lock    sync.RWMutex
+	tenants map[string]*tenant
+}
+
+// tenant 一个租户分区
+type tenant struct {
+	costs *costTracker
+	stats counters
+}
+
+// NewPartitioned 将cache实例按租户分区
+func NewPartitioned(api API, cfg PartitionConfig) *Partitioned {
+	if cfg.Tenant == nil {
+		cfg.Tenant = tenantOf
+	}
+	if cfg.Sizer == nil {
+		cfg.Sizer = estimateSize
+	}
+	p := &Partitioned{API: api, cfg: cfg, tenants: make(map[string]*tenant)}
+	for name, mb := range cfg.Quotas {
+		p.tenants[name] = newTenant(mb)
+	}
+	p.tenants[DefaultTenant] = newTenant(cfg.DefaultQuotaMB)
+	return p
+}
+
+func newTenant(quotaMB int) *tenant {
+	return &tenant{costs: newCostTracker(quotaBytes(quotaMB))}
+}
+
+// quotaBytes 配额转换为字节数，0代表不限制
+func quotaBytes(mb int) int64 {
+	if mb <= 0 {
+		return 1<<63 - 1
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+// tenantOf 默认的租户解析函数
+func tenantOf(key string) string {
+	if i := strings.IndexByte(key, ':'); i > 0 {
+		return key[:i]
+	}
+	return DefaultTenant
+}
+
+// Unwrap 返回被包装的cache实例
+func (p *Partitioned) Unwrap() API {
+	return p.API
+}
+
+// LoadDurationHistogram 返回被包装实例的自动加载耗时直方图，未实现LoadHistogram时返回空直方图
+func (p *Partitioned) LoadDurationHistogram() HistogramSnapshot {
+	if h, ok := p.API.(LoadHistogram); ok {
+		return h.LoadDurationHistogram()
+	}
+	return HistogramSnapshot{}
+}
+
+// tenant 返回key所属的分区，没有单独配额的租户归入DefaultTenant。account不为空时在读锁内调用，
+// 与SetQuota迁移分区互斥，避免占用记录到迁移前的分区
+func (p *Partitioned) tenant(key string, account func(t *tenant)) *tenant {
+	name := p.cfg.Tenant(key)
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	t, ok := p.tenants[name]
+	if !ok {
+		t = p.tenants[DefaultTenant]
+	}
+	if account != nil {
+		account(t)
+	}
+	return t
+}
+
+// Get 获取key
+func (p *Partitioned) Get(key string, value interface{}) error {
+	err := p.API.Get(key, value)
+	p.record(key, err)
+	return err
+}
+
+// GetWithLoad 返回key对应的value，不存在时加载。引擎回填成功后才记录占用，超出配额时按LRU淘汰该租户的key；
+// 未命中(包括合并到其他协程的加载)计为租户的未命中
+func (p *Partitioned) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
+	missed := false // miss回调在本协程中执行
+	ctx = withLoadHooks(ctx, loadHooks{
+		miss: func() { missed = true },
+		fill: func(loaded interface{}, ttl int64, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := p.evict(key, loaded); err != nil {
+				p.API.Delete(key) // value超过租户配额，不保留
+				return err
+			}
+			return nil
+		},
+	})
+	err := p.API.GetWithLoad(ctx, key, value, load)
+	if missed {
+		t := p.tenant(key, func(t *tenant) {
+			if err != nil {
+				t.costs.remove(key)
+			}
+		})
+		t.stats.miss()
+	} else {
+		p.record(key, err)
+	}
+	return err
+}
+
+// Set 保存一对<key, value>
+func (p *Partitioned) Set(key string, value interface{}) error {
+	return p.write(key, value, func() error { return p.API.Set(key, value) })
+}
+
+// SetWithExpire 设置key value，并指定过期时间
+func (p *Partitioned) SetWithExpire(key string, value interface{}, ttl int64) error {
+	return p.write(key, value, func() error { return p.API.SetWithExpire(key, value, ttl) })
+}
+
+// Delete 删除一个key
+func (p *Partitioned) Delete(key string) error {
+	t := p.tenant(key, func(t *tenant) { t.costs.remove(key) })
+	t.stats.delete()
+	return p.API.Delete(key)
+}
+
+// Clear 清空所有租户
+func (p *Partitioned) Clear() error {
+	p.lock.RLock()
+	for _, t := range p.tenants {
+		t.costs.clear()
+	}
+	p.lock.RUnlock()
+	return p.API.Clear()
+}
+
+// SetQuota 运行时调整租户配额，单位MB，0代表不限制；租户不存在时新建分区，
+// 该租户之前计入DefaultTenant的key移入新分区。缩小配额时立即按LRU淘汰超出的key
+func (p *Partitioned) SetQuota(name string, quotaMB int) {
+	p.lock.Lock()
+	t, ok := p.tenants[name]
+	if ok {
+		p.lock.Unlock()
+		p.deleteVictims(t, t.costs.setBudget(quotaBytes(quotaMB)))
+		return
+	}
+	t = newTenant(quotaMB)
+	p.tenants[name] = t
+	// 持有写锁迁移，迁移期间该租户的写入等待新分区就绪
+	moved := p.tenants[DefaultTenant].costs.extract(func(key string) bool { return p.cfg.Tenant(key) == name })
+	victims := t.costs.adopt(moved)
+	p.lock.Unlock()
+	p.deleteVictims(t, victims)
+}
+
+// Tenants 返回所有分区名，按字典序排列
+func (p *Partitioned) Tenants() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	names := make([]string, 0, len(p.tenants))
+	for name := range p.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TenantStats 返回租户分区的统计数据：命中、未命中、写入、删除、配额淘汰，EntryCount和BytesUsed为估算的占用。
+// 租户不存在返回false
+func (p *Partitioned) TenantStats(name string) (Stats, bool) {
+	p.lock.RLock()
+	t, ok := p.tenants[name]
+	p.lock.RUnlock()
+	if !ok {
+		return Stats{}, false
+	}
+	var stats Stats
+	t.stats.fill(&stats)
+	stats.EntryCount, stats.BytesUsed = t.costs.usage()
+	return stats, true
+}
+
+// write 调用set写入并按配额记录占用。拒绝策略先预留配额，写入失败时撤销；
+// 淘汰策略写入成功后才记录占用并淘汰，写入失败不影响该租户的其他key
+func (p *Partitioned) write(key string, value interface{}, set func() error) error {
+	cost := p.cost(key, value)
+	if p.cfg.Policy == QuotaReject {
+		reserved := false
+		p.tenant(key, func(t *tenant) { reserved = t.costs.tryAdd(key, cost) })
+		if !reserved {
+			return ErrQuotaExceeded
+		}
+		if err := set(); err != nil {
+			p.tenant(key, func(t *tenant) { t.costs.remove(key) })
+			return err
+		}
+		p.tenant(key, nil).stats.set()
+		return nil
+	}
+	if !p.tenant(key, nil).costs.fits(cost) {
+		return ErrValueTooLarge
+	}
+	if err := set(); err != nil {
+		return err
+	}
+	if err := p.evict(key, value); err != nil {
+		p.API.Delete(key) // 写入期间配额被缩小，value超过租户配额，不保留
+		return err
+	}
+	p.tenant(key, nil).stats.set()
+	return nil
+}
+
+// evict 记录key的占用，超出配额时淘汰该租户最久未使用的key
+func (p *Partitioned) evict(key string, value interface{}) error {
+	cost := p.cost(key, value)
+	var victims []string
+	var err error
+	t := p.tenant(key, func(t *tenant) { victims, err = t.costs.add(key, cost) })
+	if err != nil {
+		return err
+	}
+	p.deleteVictims(t, victims)
+	return nil
+}
+
+func (p *Partitioned) deleteVictims(t *tenant, victims []string) {
+	for _, victim := range victims {
+		p.API.Delete(victim)
+	}
+	t.stats.evict(int64(len(victims)))
+}
+
+func (p *Partitioned) cost(key string, value interface{}) int64 {
+	return int64(len(key) + p.cfg.Sizer(value))
+}
+
+// record 记录读取结果，未命中时扣除key的占用(可能已被引擎淘汰或过期)
+func (p *Partitioned) record(key string, err error) {
+	switch {
+	case err == nil:
+		p.tenant(key, func(t *tenant) { t.costs.touch(key) }).stats.hit()
+	case err == ErrNotFound, errors.Is(err, ErrDecode): // 无法解析的key已被引擎删除
+		p.tenant(key, func(t *tenant) { t.costs.remove(key) }).stats.miss()
+	case errors.Is(err, ErrCannotSet): // 读取目标类型不匹配，key仍在引擎中
+		p.tenant(key, nil).stats.miss()
+	}
+}
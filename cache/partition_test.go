@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitioned(t *testing.T) {
+	api, err := New(EngineLocalCache, 10)
+	assert.Nil(t, err)
+	size := func(value interface{}) int {
+		if s, ok := value.(*string); ok { // GetWithLoad回填的是指针
+			return len(*s)
+		}
+		return len(value.(string))
+	}
+	p := NewPartitioned(api, PartitionConfig{Quotas: map[string]int{"a": 1, "b": 1}, Sizer: size})
+	big := strings.Repeat("x", 400*1024)
+
+	// a超出配额只淘汰a自己的key
+	assert.Nil(t, p.Set("b:1", big))
+	for _, key := range []string{"a:1", "a:2", "a:3"} {
+		assert.Nil(t, p.Set(key, big))
+	}
+	var value string
+	assert.Equal(t, ErrNotFound, p.Get("a:1", &value))
+	assert.Nil(t, p.Get("a:3", &value))
+	assert.Nil(t, p.Get("b:1", &value))
+	stats, ok := p.TenantStats("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, int64(2), stats.EntryCount)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	stats, _ = p.TenantStats("b")
+	assert.Equal(t, int64(0), stats.Evictions)
+
+	// 没有配额的租户归入DefaultTenant
+	assert.Nil(t, p.Set("c:1", "v"))
+	assert.Nil(t, p.Set("nokey", "v"))
+	stats, _ = p.TenantStats(DefaultTenant)
+	assert.Equal(t, int64(2), stats.EntryCount)
+	assert.Equal(t, []string{"a", "b", DefaultTenant}, p.Tenants())
+
+	// 运行时新建租户，之前计入DefaultTenant的key移入新分区
+	p.SetQuota("a", 0)
+	p.SetQuota("b", 1)
+	p.SetQuota("c", 1)
+	stats, _ = p.TenantStats(DefaultTenant)
+	assert.Equal(t, int64(1), stats.EntryCount)
+	assert.Nil(t, p.Set("c:2", big))
+	stats, _ = p.TenantStats("c")
+	assert.Equal(t, int64(2), stats.EntryCount)
+	// 缩小配额立即淘汰
+	p.SetQuota("c", 0)
+	p.SetQuota("c", 1)
+	assert.Nil(t, p.Set("c:3", big))
+	assert.Nil(t, p.Set("c:4", big))
+	stats, _ = p.TenantStats("c")
+	assert.Equal(t, int64(2), stats.EntryCount)
+	p.SetQuota("c", 0)
+	assert.Nil(t, p.Set("c:5", big))
+	p.SetQuota("c", 1)
+	stats, _ = p.TenantStats("c")
+	assert.Equal(t, int64(2), stats.EntryCount)
+	assert.Equal(t, ErrNotFound, p.Get("c:3", &value))
+
+	// 引擎回填成功后才记录占用
+	load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		*value.(*string) = big
+		return 0, nil
+	}
+	assert.Nil(t, p.GetWithLoad(context.Background(), "b:2", &value, load))
+	assert.Nil(t, p.GetWithLoad(context.Background(), "b:2", &value, load))
+	stats, _ = p.TenantStats("b")
+	assert.Equal(t, int64(2), stats.EntryCount)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(2), stats.Hits) // 含前面命中的b:1
+	dropped := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		api.Delete(key) // 加载期间删除，回填被丢弃
+		return load(ctx, key, value)
+	}
+	assert.Nil(t, p.GetWithLoad(context.Background(), "b:3", &value, dropped))
+	stats, _ = p.TenantStats("b")
+	assert.Equal(t, int64(2), stats.EntryCount)
+	// 合并到其他协程的加载也计为未命中
+	release := make(chan struct{})
+	slow := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		<-release
+		return load(ctx, key, value)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var value string
+			assert.Nil(t, p.GetWithLoad(context.Background(), "b:4", &value, slow))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	misses := stats.Misses
+	stats, _ = p.TenantStats("b")
+	assert.Equal(t, misses+2, stats.Misses)
+
+	// 拒绝策略
+	p = NewPartitioned(api, PartitionConfig{Quotas: map[string]int{"a": 1}, Policy: QuotaReject, Sizer: size})
+	assert.Nil(t, p.Set("a:1", big))
+	assert.Nil(t, p.Set("a:2", big))
+	assert.Equal(t, ErrQuotaExceeded, p.Set("a:3", big))
+	assert.Nil(t, p.Set("a:2", "small")) // 覆盖已有key不超出配额
+	assert.Nil(t, p.Delete("a:1"))
+	assert.Nil(t, p.Set("a:3", big))
+
+	// 写入失败时不淘汰该租户的其他key
+	assert.Nil(t, api.Clear())
+	failing := &failingSet{API: api}
+	p = NewPartitioned(failing, PartitionConfig{Quotas: map[string]int{"a": 1}, Sizer: size})
+	assert.Nil(t, p.Set("a:1", big))
+	assert.Nil(t, p.Set("a:2", big))
+	failing.err = ErrValueTooLarge
+	assert.Equal(t, ErrValueTooLarge, p.Set("a:3", big))
+	failing.err = nil
+	assert.Nil(t, p.Get("a:1", &value))
+	stats, _ = p.TenantStats("a")
+	assert.Equal(t, int64(0), stats.Evictions)
+	assert.Equal(t, int64(2), stats.EntryCount)
+	// 超过租户配额的value不写入，不覆盖旧值
+	assert.Equal(t, ErrValueTooLarge, p.Set("a:1", strings.Repeat("x", 2*1024*1024)))
+	assert.Nil(t, p.Get("a:1", &value))
+	assert.Equal(t, big, value)
+}
+
+// failingSet err不为空时Set返回err
+type failingSet struct {
+	API
+	err error
+}
+
+func (f *failingSet) Set(key string, value interface{}) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.API.Set(key, value)
+}
+
+func TestPartitionedSetQuotaRace(t *testing.T) {
+	api, err := New(EngineLocalCache, 10)
+	assert.Nil(t, err)
+	p := NewPartitioned(api, PartitionConfig{})
+	// 新建分区与写入并发，写入的key都记录在新分区
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				assert.Nil(t, p.Set(fmt.Sprintf("d:%d_%d", i, j), "v"))
+			}
+		}(i)
+	}
+	p.SetQuota("d", 0)
+	wg.Wait()
+	stats, _ := p.TenantStats(DefaultTenant)
+	assert.Equal(t, int64(0), stats.EntryCount)
+	stats, _ = p.TenantStats("d")
+	assert.Equal(t, int64(800), stats.EntryCount)
+}
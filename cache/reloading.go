@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.code.oa.com/trpc-go/trpc-go/log"
+)
+
+const defaultReloadInterval = time.Minute
+
+// LoadAllFunc 加载全量数据，返回的map交给Reloading后不能再修改
+type LoadAllFunc func(ctx context.Context) (map[string]interface{}, error)
+
+// ReloadingConfig 全量加载配置
+type ReloadingConfig struct {
+	Interval time.Duration // 定时全量加载的间隔，默认1分钟
+	Timeout  time.Duration // 单次全量加载的超时时间，0代表不限制
+}
+
+// Reloading 全量数据cache，适用于配置表等数据量小、需要整体替换的数据。
+// 启动时及每个Interval调用LoadAllFunc加载全量数据并原子替换，加载失败时保留旧数据，key没有单独的过期时间
+type Reloading struct {
+	load     LoadAllFunc
+	cfg      ReloadingConfig
+	snapshot atomic.Value // *reloadSnapshot
+	lock     sync.Mutex   // 保护lastErr，并串行执行Reload
+	lastErr  error
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// reloadSnapshot 一次成功加载的全量数据
+type reloadSnapshot struct {
+	data     map[string]interface{}
+	version  uint64
+	loadedAt time.Time
+}
+
+// NewReloading 同步执行首次全量加载，失败返回错误；成功后启动后台定时加载，不再使用时调用Close停止
+func NewReloading(ctx context.Context, load LoadAllFunc, cfg ReloadingConfig) (*Reloading, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultReloadInterval
+	}
+	r := &Reloading{load: load, cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+	r.snapshot.Store(&reloadSnapshot{})
+	if err := r.Reload(ctx); err != nil {
+		return nil, err
+	}
+	go r.reloadLoop()
+	return r, nil
+}
+
+// Get 获取key，value必须是非空指针，保存的值可以是同类型的值或指针，类型不匹配返回ErrCannotSet。
+// 保存的是指针、map、slice时调用方与cache共享同一份数据，不能修改
+func (r *Reloading) Get(key string, value interface{}) error {
+	v, ok := r.current().data[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if !assignValue(value, v) {
+		return ErrCannotSet
+	}
+	return nil
+}
+
+// Len 当前数据的key数量
+func (r *Reloading) Len() int {
+	return len(r.current().data)
+}
+
+// Version 当前数据的版本号，每次加载成功加1，从1开始
+func (r *Reloading) Version() uint64 {
+	return r.current().version
+}
+
+// LastSuccess 最近一次加载成功的时间
+func (r *Reloading) LastSuccess() time.Time {
+	return r.current().loadedAt
+}
+
+// LastError 最近一次加载的错误，成功时为nil
+func (r *Reloading) LastError() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastErr
+}
+
+// Reload 立即全量加载一次，成功后原子替换数据，失败保留旧数据并返回错误。
+// 超时从拿到锁开始计算，Close时取消正在执行的加载
+func (r *Reloading) Reload(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	if r.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Timeout)
+		defer cancel()
+	}
+	go func() {
+		select {
+		case <-r.stop:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	data, err := r.load(ctx)
+	r.lastErr = err
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	r.snapshot.Store(&reloadSnapshot{data: data, version: r.current().version + 1, loadedAt: time.Now()})
+	return nil
+}
+
+// Close 停止后台定时加载并取消正在执行的加载，已加载的数据仍可读取
+func (r *Reloading) Close() error {
+	r.once.Do(func() {
+		close(r.stop)
+		<-r.done
+	})
+	return nil
+}
+
+func (r *Reloading) current() *reloadSnapshot {
+	return r.snapshot.Load().(*reloadSnapshot)
+}
+
+func (r *Reloading) reloadLoop() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Reload(context.Background()); err != nil {
+				log.Errorf("cache reload failed, keep version %d: %v", r.Version(), err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloading(t *testing.T) {
+	var loads int32
+	failing := int32(1)
+	load := func(ctx context.Context) (map[string]interface{}, error) {
+		n := atomic.AddInt32(&loads, 1)
+		if n > 1 && atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("db down")
+		}
+		return map[string]interface{}{"a": int(n), "b": "bar"}, nil
+	}
+
+	r, err := NewReloading(context.Background(), load, ReloadingConfig{Interval: 10 * time.Millisecond})
+	assert.Nil(t, err)
+	defer r.Close()
+	assert.Equal(t, uint64(1), r.Version())
+	assert.Equal(t, 2, r.Len())
+	assert.False(t, r.LastSuccess().IsZero())
+	var a int
+	assert.Nil(t, r.Get("a", &a))
+	assert.Equal(t, 1, a)
+	var b string
+	assert.Equal(t, ErrCannotSet, r.Get("a", &b))
+	assert.Equal(t, ErrNotFound, r.Get("c", &b))
+
+	// 加载失败保留旧数据
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&loads) > 2 }, time.Second, time.Millisecond)
+	assert.NotNil(t, r.LastError())
+	assert.Equal(t, uint64(1), r.Version())
+	assert.Nil(t, r.Get("a", &a))
+	assert.Equal(t, 1, a)
+
+	// 恢复后原子替换
+	atomic.StoreInt32(&failing, 0)
+	assert.Eventually(t, func() bool { return r.Version() > 1 }, time.Second, time.Millisecond)
+	assert.Nil(t, r.Get("a", &a))
+	assert.Greater(t, a, 1)
+
+	_, err = NewReloading(context.Background(), func(ctx context.Context) (map[string]interface{}, error) {
+		return nil, errors.New("db down")
+	}, ReloadingConfig{})
+	assert.NotNil(t, err)
+
+	// Close取消正在执行的加载，超时从拿到锁开始计算
+	blocking := int32(0)
+	r, err = NewReloading(context.Background(), func(ctx context.Context) (map[string]interface{}, error) {
+		if atomic.LoadInt32(&blocking) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return map[string]interface{}{}, nil
+	}, ReloadingConfig{Interval: time.Hour, Timeout: time.Hour})
+	assert.Nil(t, err)
+	atomic.StoreInt32(&blocking, 1)
+	reloaded := make(chan error)
+	go func() { reloaded <- r.Reload(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, context.Canceled, <-reloaded)
+	assert.Equal(t, uint64(1), r.Version())
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// 内置序列化方式名
+const (
+	SerializerJSON = "json"
+)
+
+// 内置压缩方式名
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// Compressor 用于value压缩的接口
+type Compressor interface {
+	Compress(in []byte) (out []byte, err error)
+	Decompress(in []byte) (out []byte, err error)
+}
+
+var (
+	codecLock   = sync.RWMutex{}
+	serializers = map[string]Serializer{
+		SerializerJSON: jsoniter.ConfigCompatibleWithStandardLibrary,
+	}
+	compressors = map[string]Compressor{
+		CompressionGzip: gzipCompressor{},
+	}
+)
+
+// RegisterSerializer 注册一个命名的序列化实例，供配置文件按名字引用
+func RegisterSerializer(name string, s Serializer) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	serializers[name] = s
+}
+
+// GetSerializer 根据名字返回序列化实例，不存在返回nil
+func GetSerializer(name string) Serializer {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	return serializers[name]
+}
+
+// RegisterCompressor 注册一个命名的压缩实例，供配置文件按名字引用
+func RegisterCompressor(name string, c Compressor) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	compressors[name] = c
+}
+
+// GetCompressor 根据名字返回压缩实例，不存在返回nil
+func GetCompressor(name string) Compressor {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	return compressors[name]
+}
+
+// compressSerializer 先序列化再压缩
+type compressSerializer struct {
+	Serializer
+	compressor Compressor
+}
+
+// Marshal 序列化后压缩
+func (s *compressSerializer) Marshal(body interface{}) ([]byte, error) {
+	data, err := s.Serializer.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return s.compressor.Compress(data)
+}
+
+// Unmarshal 解压后反序列化
+func (s *compressSerializer) Unmarshal(in []byte, body interface{}) error {
+	data, err := s.compressor.Decompress(in)
+	if err != nil {
+		return err
+	}
+	return s.Serializer.Unmarshal(data, body)
+}
+
+type gzipCompressor struct{}
+
+// Compress gzip压缩
+func (gzipCompressor) Compress(in []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(in); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress gzip解压
+func (gzipCompressor) Decompress(in []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"reflect"
+)
+
+// Sizer 估算value占用的内存字节数，用于不经过序列化的引擎(localcache)按字节限制内存
+type Sizer func(value interface{}) int
+
+const maxSizeDepth = 16 // 反射估算的最大递归深度，防止过深的嵌套结构拖慢Set
+
+// estimateSize 默认Sizer，通过反射估算value及其引用的数据占用的字节数，
+// 同一个指针/map/slice底层数据只计算一次
+func estimateSize(value interface{}) int {
+	if value == nil {
+		return 0
+	}
+	visited := make(map[uintptr]bool)
+	return sizeOf(reflect.ValueOf(value), visited, 0)
+}
+
+func sizeOf(v reflect.Value, visited map[uintptr]bool, depth int) int {
+	size := int(v.Type().Size())
+	if depth > maxSizeDepth {
+		return size
+	}
+	return size + referencedSize(v, visited, depth)
+}
+
+// referencedSize 计算v间接引用的数据大小，不含v本身
+func referencedSize(v reflect.Value, visited map[uintptr]bool, depth int) int {
+	switch v.Kind() {
+	case reflect.String:
+		return v.Len()
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		if v.Kind() == reflect.Ptr {
+			if visited[v.Pointer()] {
+				return 0
+			}
+			visited[v.Pointer()] = true
+		}
+		return sizeOf(v.Elem(), visited, depth+1)
+	case reflect.Slice:
+		if v.IsNil() || visited[v.Pointer()] {
+			return 0
+		}
+		visited[v.Pointer()] = true
+		size := v.Cap() * int(v.Type().Elem().Size())
+		if !hasReference(v.Type().Elem()) {
+			return size
+		}
+		for i := 0; i < v.Len(); i++ {
+			size += referencedSize(v.Index(i), visited, depth+1)
+		}
+		return size
+	case reflect.Array:
+		var size int
+		if hasReference(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += referencedSize(v.Index(i), visited, depth+1)
+			}
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || visited[v.Pointer()] {
+			return 0
+		}
+		visited[v.Pointer()] = true
+		var size int
+		iter := v.MapRange()
+		for iter.Next() {
+			size += sizeOf(iter.Key(), visited, depth+1) + sizeOf(iter.Value(), visited, depth+1)
+		}
+		return size
+	case reflect.Struct:
+		var size int
+		for i := 0; i < v.NumField(); i++ {
+			size += referencedSize(v.Field(i), visited, depth+1)
+		}
+		return size
+	default:
+		return 0
+	}
+}
+
+// hasReference 类型t是否可能引用额外的内存
+func hasReference(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return true
+	case reflect.Array:
+		return hasReference(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasReference(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
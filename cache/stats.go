@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// counters 各引擎共用的统计计数，均为原子操作
+type counters struct {
+	hits            int64
+	misses          int64
+	sets            int64
+	deletes         int64
+	loads           int64
+	loadErrors      int64
+	serializeErrors int64
+	decodeErrors    int64
+	evictions       int64
+	expirations     int64
+	earlyRefreshes  int64
+	staleHits       int64
+	breakerOpens    int64
+	leaseDrops      int64
+	fillErrors      int64
+	eventDrops      int64
+	loadDuration    histogram
+	window          window // 最近一段时间的滑动窗口统计
+}
+
+func (c *counters) hit() {
+	atomic.AddInt64(&c.hits, 1)
+	atomic.AddInt64(&c.window.current().hits, 1)
+}
+
+func (c *counters) miss() {
+	atomic.AddInt64(&c.misses, 1)
+	atomic.AddInt64(&c.window.current().misses, 1)
+}
+
+func (c *counters) set()            { atomic.AddInt64(&c.sets, 1) }
+func (c *counters) delete()         { atomic.AddInt64(&c.deletes, 1) }
+func (c *counters) serializeError() { atomic.AddInt64(&c.serializeErrors, 1) }
+func (c *counters) decodeError()    { atomic.AddInt64(&c.decodeErrors, 1) }
+func (c *counters) evict(n int64)   { atomic.AddInt64(&c.evictions, n) }
+func (c *counters) expire(n int64)  { atomic.AddInt64(&c.expirations, n) }
+func (c *counters) earlyRefresh()   { atomic.AddInt64(&c.earlyRefreshes, 1) }
+func (c *counters) staleHit()       { atomic.AddInt64(&c.staleHits, 1) }
+func (c *counters) breakerOpen()    { atomic.AddInt64(&c.breakerOpens, 1) }
+func (c *counters) leaseDrop()      { atomic.AddInt64(&c.leaseDrops, 1) }
+func (c *counters) fillError()      { atomic.AddInt64(&c.fillErrors, 1) }
+func (c *counters) eventDrop()      { atomic.AddInt64(&c.eventDrops, 1) }
+
+// load 记录一次自动加载及其耗时
+func (c *counters) load(cost time.Duration) {
+	atomic.AddInt64(&c.loads, 1)
+	c.loadDuration.observe(cost)
+	b := c.window.current()
+	atomic.AddInt64(&b.loads, 1)
+	b.loadDuration.observe(cost)
+}
+
+func (c *counters) loadError() {
+	atomic.AddInt64(&c.loadErrors, 1)
+	atomic.AddInt64(&c.window.current().loadErrors, 1)
+}
+
+// fill 将计数填充到stats，引擎特有的字段由引擎自己填充
+func (c *counters) fill(stats *Stats) {
+	stats.Hits = atomic.LoadInt64(&c.hits)
+	stats.Misses = atomic.LoadInt64(&c.misses)
+	stats.HitRate = stats.calcHitRate()
+	stats.Loads = atomic.LoadInt64(&c.loads)
+	stats.Sets = atomic.LoadInt64(&c.sets)
+	stats.Deletes = atomic.LoadInt64(&c.deletes)
+	stats.LoadErrors = atomic.LoadInt64(&c.loadErrors)
+	stats.SerializeErrors = atomic.LoadInt64(&c.serializeErrors)
+	stats.DecodeErrors = atomic.LoadInt64(&c.decodeErrors)
+	stats.Evictions = atomic.LoadInt64(&c.evictions)
+	stats.Expirations = atomic.LoadInt64(&c.expirations)
+	stats.EarlyRefreshes = atomic.LoadInt64(&c.earlyRefreshes)
+	stats.StaleHits = atomic.LoadInt64(&c.staleHits)
+	stats.BreakerOpens = atomic.LoadInt64(&c.breakerOpens)
+	stats.LeaseDrops = atomic.LoadInt64(&c.leaseDrops)
+	stats.FillErrors = atomic.LoadInt64(&c.fillErrors)
+	stats.EventDrops = atomic.LoadInt64(&c.eventDrops)
+	stats.LoadDurationP50 = c.loadDuration.percentile(0.5)
+	stats.LoadDurationP90 = c.loadDuration.percentile(0.9)
+	stats.LoadDurationP99 = c.loadDuration.percentile(0.99)
+}
+
+func (c *counters) reset() {
+	for _, v := range []*int64{&c.hits, &c.misses, &c.sets, &c.deletes, &c.loads, &c.loadErrors,
+		&c.serializeErrors, &c.decodeErrors, &c.evictions, &c.expirations, &c.earlyRefreshes, &c.staleHits, &c.breakerOpens,
+		&c.leaseDrops, &c.fillErrors, &c.eventDrops} {
+		atomic.StoreInt64(v, 0)
+	}
+	c.loadDuration.reset()
+	c.window.reset()
+}
+
+const (
+	histogramMinBound = 100 * time.Microsecond // 第一个桶的上界，之后每个桶上界翻倍
+	histogramBuckets  = 22                     // 最后一个桶的上界约为7分钟，超出的计入最后一个桶
+)
+
+// histogram 按指数分桶的耗时直方图，分位数精度为桶的上界
+type histogram struct {
+	counts [histogramBuckets]int64
+	sum    int64 // 总耗时，单位纳秒
+}
+
+// HistogramSnapshot 耗时直方图快照
+type HistogramSnapshot struct {
+	UpperBounds []time.Duration // 各桶的上界，递增
+	Counts      []int64         // 各桶的次数(非累计)，超过最后一个上界的也计入最后一个桶
+	Sum         time.Duration   // 总耗时
+}
+
+// LoadHistogram 提供自动加载耗时直方图，内置引擎均已实现，用于对接监控系统
+type LoadHistogram interface {
+	LoadDurationHistogram() HistogramSnapshot
+}
+
+func (h *histogram) observe(cost time.Duration) {
+	i, bound := 0, histogramMinBound
+	for cost > bound && i < histogramBuckets-1 {
+		i, bound = i+1, bound*2
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(cost))
+}
+
+// snapshot 返回直方图快照
+func (h *histogram) snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		UpperBounds: make([]time.Duration, histogramBuckets),
+		Counts:      make([]int64, histogramBuckets),
+		Sum:         time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	bound := histogramMinBound
+	for i := range h.counts {
+		snapshot.UpperBounds[i], snapshot.Counts[i] = bound, atomic.LoadInt64(&h.counts[i])
+		bound *= 2
+	}
+	return snapshot
+}
+
+// percentile 返回分位数p(0~1)所在桶的上界，没有数据返回0
+func (h *histogram) percentile(p float64) time.Duration {
+	var counts [histogramBuckets]int64
+	h.addTo(&counts)
+	return percentile(&counts, p)
+}
+
+// addTo 将各桶计数累加到counts
+func (h *histogram) addTo(counts *[histogramBuckets]int64) {
+	for i := range h.counts {
+		counts[i] += atomic.LoadInt64(&h.counts[i])
+	}
+}
+
+func (h *histogram) reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.sum, 0)
+}
+
+// percentile 根据各桶计数返回分位数p(0~1)所在桶的上界，没有数据返回0
+func percentile(counts *[histogramBuckets]int64, p float64) time.Duration {
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(p*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var cumulative int64
+	bound := histogramMinBound
+	for i := range counts {
+		if cumulative += counts[i]; cumulative >= rank {
+			break
+		}
+		bound *= 2
+	}
+	return bound
+}
+
+const (
+	windowBucketWidth = 5 * time.Second                         // 滑动窗口每个桶的时间跨度
+	windowBuckets     = int(MaxStatsWindow / windowBucketWidth) // 滑动窗口的桶数
+)
+
+// MaxStatsWindow GetWindowStats支持的最大时间窗口
+const MaxStatsWindow = 15 * time.Minute
+
+// window 按时间分桶的环形缓冲区，每个桶记录windowBucketWidth内的计数。
+// 写入只有原子操作，桶过期后由第一个写入者清零，清零期间并发写入的少量计数可能丢失
+type window struct {
+	buckets [windowBuckets]windowBucket
+}
+
+type windowBucket struct {
+	epoch        int64 // 桶对应的时间序号，即unix纳秒/windowBucketWidth
+	hits         int64
+	misses       int64
+	loads        int64
+	loadErrors   int64
+	loadDuration histogram
+}
+
+// current 返回当前时间对应的桶，桶里是过期数据时先清零
+func (w *window) current() *windowBucket {
+	epoch := time.Now().UnixNano() / int64(windowBucketWidth)
+	b := &w.buckets[epoch%int64(windowBuckets)]
+	if old := atomic.LoadInt64(&b.epoch); old != epoch && atomic.CompareAndSwapInt64(&b.epoch, old, epoch) {
+		b.reset()
+	}
+	return b
+}
+
+func (b *windowBucket) reset() {
+	atomic.StoreInt64(&b.hits, 0)
+	atomic.StoreInt64(&b.misses, 0)
+	atomic.StoreInt64(&b.loads, 0)
+	atomic.StoreInt64(&b.loadErrors, 0)
+	b.loadDuration.reset()
+}
+
+// stats 汇总最近d时间内的统计，d按桶宽向上取整，不超过MaxStatsWindow
+func (w *window) stats(d time.Duration) WindowStats {
+	n := int((d + windowBucketWidth - 1) / windowBucketWidth)
+	if n < 1 {
+		n = 1
+	} else if n > windowBuckets {
+		n = windowBuckets
+	}
+	stats := WindowStats{Window: time.Duration(n) * windowBucketWidth}
+	var counts [histogramBuckets]int64
+	epoch := time.Now().UnixNano() / int64(windowBucketWidth)
+	for i := 0; i < n; i++ {
+		b := &w.buckets[(epoch-int64(i))%int64(windowBuckets)]
+		if atomic.LoadInt64(&b.epoch) != epoch-int64(i) {
+			continue
+		}
+		stats.Hits += atomic.LoadInt64(&b.hits)
+		stats.Misses += atomic.LoadInt64(&b.misses)
+		stats.Loads += atomic.LoadInt64(&b.loads)
+		stats.LoadErrors += atomic.LoadInt64(&b.loadErrors)
+		b.loadDuration.addTo(&counts)
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	stats.LoadDurationP50 = percentile(&counts, 0.5)
+	stats.LoadDurationP90 = percentile(&counts, 0.9)
+	stats.LoadDurationP99 = percentile(&counts, 0.99)
+	return stats
+}
+
+func (w *window) reset() {
+	for i := range w.buckets {
+		atomic.StoreInt64(&w.buckets[i].epoch, 0)
+		w.buckets[i].reset()
+	}
+}
@@ -0,0 +1,360 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"git.code.oa.com/trpc-go/trpc-go/log"
+)
+
+const (
+	defaultStoreQueueSize     = 10000
+	defaultStoreBatchSize     = 100
+	defaultStoreFlushInterval = time.Second
+	defaultStoreMaxRetries    = 3
+	defaultStoreRetryBackoff  = 100 * time.Millisecond
+	storeKeyLocks             = 64 // 按key分段的写锁数量
+)
+
+// NoRetry StoreConfig.MaxRetries取该值时写回失败不重试，直接调用OnError
+const NoRetry = -1
+
+// Store cache背后的持久化存储，如数据库
+type Store interface {
+	// Load 加载key对应的value，签名同LoadFunc，不存在返回ErrNotFound
+	Load(ctx context.Context, key string, value interface{}) (ttl int64, err error)
+	// Save 保存key对应的value
+	Save(ctx context.Context, key string, value interface{}) error
+	// Delete 删除key，key不存在不返回错误
+	Delete(ctx context.Context, key string) error
+}
+
+// StoreOp 异步写回存储的一次操作
+type StoreOp struct {
+	Key    string
+	Value  interface{} // Delete为true时为空
+	Delete bool
+}
+
+// BatchStore 支持批量写的Store，异步写回时一批操作一次写入
+type BatchStore interface {
+	Store
+	// Batch 按顺序执行一批操作，同一批中key不重复
+	Batch(ctx context.Context, ops []StoreOp) error
+}
+
+// StoreConfig WithStore配置
+type StoreConfig struct {
+	// WriteBehind 为false时同步写穿：先写Store，成功后再写cache；
+	// 为true时异步写回：先写cache，再放入队列由后台批量写Store
+	WriteBehind   bool
+	QueueSize     int           // 异步写回队列中最多等待的key数量，同一个key的多次写合并，满时返回ErrQueueFull，默认10000
+	BatchSize     int           // 每批写回的最大操作数，默认100
+	FlushInterval time.Duration // 队列未满一批时的写回间隔，默认1秒
+	MaxRetries    int           // 写回失败的重试次数，0使用默认值3，NoRetry(或其他负数)不重试
+	RetryBackoff  time.Duration // 第一次重试前的等待时间，之后每次翻倍，默认100毫秒
+	// OnError 重试后仍失败时回调，默认只记录日志
+	OnError func(ops []StoreOp, err error)
+}
+
+// storeCache WithStore返回的cache实例
+type storeCache struct {
+	API
+	store Store
+	cfg   StoreConfig
+
+	keyLocks [storeKeyLocks]sync.Mutex // 同一个key写Store和写cache串行执行，保证两者最终一致
+
+	lock     sync.Mutex
+	pending  map[string]*StoreOp // 等待写回的操作，同一个key只保留最后一次
+	order    []string            // pending中key的写入顺序
+	inflight map[string]*StoreOp // 正在写回的操作
+	notify   chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// WithStore 使用Store包装cache实例，Set/SetWithExpire/Delete同时写Store，GetWithLoad的load为nil时通过Store.Load加载。
+// Clear只清空cache，不影响Store。异步写回时value放入队列后不能再修改，Close会先写回队列中的所有操作再关闭cache实例
+func WithStore(api API, store Store, cfg StoreConfig) API {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultStoreQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultStoreBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultStoreFlushInterval
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultStoreMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultStoreRetryBackoff
+	}
+	s := &storeCache{API: api, store: store, cfg: cfg}
+	if cfg.WriteBehind {
+		s.pending = make(map[string]*StoreOp)
+		s.inflight = make(map[string]*StoreOp)
+		s.notify = make(chan struct{}, 1)
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.writeLoop()
+	}
+	return s
+}
+
+// Unwrap 返回被包装的cache实例
+func (s *storeCache) Unwrap() API {
+	return s.API
+}
+
+// LoadDurationHistogram 返回被包装实例的自动加载耗时直方图，未实现LoadHistogram时返回空直方图
+func (s *storeCache) LoadDurationHistogram() HistogramSnapshot {
+	if h, ok := s.API.(LoadHistogram); ok {
+		return h.LoadDurationHistogram()
+	}
+	return HistogramSnapshot{}
+}
+
+// Pending 异步写回队列中等待及正在写回的操作数
+func (s *storeCache) Pending() int {
+	if !s.cfg.WriteBehind {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pending) + len(s.inflight)
+}
+
+// GetWithLoad load为nil时通过Store加载
+func (s *storeCache) GetWithLoad(ctx context.Context, key string, value interface{}, load LoadFunc) error {
+	if load == nil {
+		load = s.load
+	}
+	return s.API.GetWithLoad(ctx, key, value, load)
+}
+
+// load 通过Store加载，异步写回时key还有未写回的操作则以该操作为准，避免读到Store中的旧数据
+func (s *storeCache) load(ctx context.Context, key string, value interface{}) (int64, error) {
+	if s.cfg.WriteBehind {
+		s.lock.Lock()
+		op := s.pending[key]
+		if op == nil {
+			op = s.inflight[key]
+		}
+		s.lock.Unlock()
+		if op != nil {
+			if op.Delete {
+				return 0, ErrNotFound
+			}
+			if assignValue(value, op.Value) {
+				return 0, nil
+			}
+		}
+	}
+	return s.store.Load(ctx, key, value)
+}
+
+// Set 保存一对<key, value>
+func (s *storeCache) Set(key string, value interface{}) error {
+	return s.write(key, value, func() error { return s.API.Set(key, value) })
+}
+
+// SetWithExpire 设置key value，并指定过期时间
+func (s *storeCache) SetWithExpire(key string, value interface{}, ttl int64) error {
+	return s.write(key, value, func() error { return s.API.SetWithExpire(key, value, ttl) })
+}
+
+// Delete 删除一个key
+func (s *storeCache) Delete(key string) error {
+	lock := s.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.cfg.WriteBehind {
+		if err := s.API.Delete(key); err != nil {
+			return err
+		}
+		return s.enqueue(&StoreOp{Key: key, Delete: true})
+	}
+	if err := s.store.Delete(context.Background(), key); err != nil {
+		return err
+	}
+	return s.API.Delete(key)
+}
+
+// Close 异步写回时先写回队列中的所有操作，再关闭cache实例
+func (s *storeCache) Close() error {
+	if s.cfg.WriteBehind {
+		s.lock.Lock()
+		select {
+		case <-s.stop:
+		default:
+			close(s.stop)
+		}
+		s.lock.Unlock()
+		<-s.done
+	}
+	return CloseInstance(s.API)
+}
+
+// write 写穿时先写Store再调用set写cache，写cache失败时删除cache中的key；写回时先写cache，成功后再入队，入队失败时删除cache中的key，
+// 下次读取从Store加载。同一个key的写入按key加锁串行，避免并发写入后cache和Store的数据不一致
+func (s *storeCache) write(key string, value interface{}, set func() error) error {
+	lock := s.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.cfg.WriteBehind {
+		if err := set(); err != nil {
+			return err
+		}
+		if err := s.enqueue(&StoreOp{Key: key, Value: value}); err != nil {
+			s.API.Delete(key)
+			return err
+		}
+		return nil
+	}
+	if err := s.store.Save(context.Background(), key, value); err != nil {
+		return err
+	}
+	if err := set(); err != nil {
+		s.API.Delete(key) // cache中是旧数据，删除后从Store重新加载
+		return err
+	}
+	return nil
+}
+
+// keyLock 返回key所在分段的写锁
+func (s *storeCache) keyLock(key string) *sync.Mutex {
+	h := uint32(2166136261) // FNV-1a
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint32(key[i])) * 16777619
+	}
+	return &s.keyLocks[h%storeKeyLocks]
+}
+
+// enqueue 放入写回队列，同一个key合并为最后一次操作
+func (s *storeCache) enqueue(op *StoreOp) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.stop:
+		return ErrClosed
+	default:
+	}
+	if _, ok := s.pending[op.Key]; !ok {
+		if len(s.pending) >= s.cfg.QueueSize {
+			return ErrQueueFull
+		}
+		s.order = append(s.order, op.Key)
+	}
+	s.pending[op.Key] = op
+	if len(s.pending) >= s.cfg.BatchSize {
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// writeLoop 后台写回，攒够一批或到达FlushInterval时写回，停止时写回所有剩余操作
+func (s *storeCache) writeLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.notify:
+			s.flush(false)
+		case <-ticker.C:
+			s.flush(true)
+		case <-s.stop:
+			s.flush(true)
+			return
+		}
+	}
+}
+
+// flush 写回队列中的操作，all为false时只写回满一批的部分
+func (s *storeCache) flush(all bool) {
+	for {
+		ops := s.take(all)
+		if len(ops) == 0 {
+			return
+		}
+		s.apply(ops)
+		s.lock.Lock()
+		for i := range ops {
+			if s.inflight[ops[i].Key] == &ops[i] {
+				delete(s.inflight, ops[i].Key)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// take 按写入顺序取出最多BatchSize个操作，移入inflight
+func (s *storeCache) take(all bool) []StoreOp {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.order) == 0 || (!all && len(s.order) < s.cfg.BatchSize) {
+		return nil
+	}
+	n := len(s.order)
+	if n > s.cfg.BatchSize {
+		n = s.cfg.BatchSize
+	}
+	ops := make([]StoreOp, n)
+	for i, key := range s.order[:n] {
+		ops[i] = *s.pending[key]
+		delete(s.pending, key)
+		s.inflight[key] = &ops[i]
+	}
+	s.order = append(s.order[:0], s.order[n:]...)
+	return ops
+}
+
+// apply 写回一批操作，失败按指数退避重试
+func (s *storeCache) apply(ops []StoreOp) {
+	backoff := s.cfg.RetryBackoff
+	var err error
+	for i := 0; ; i++ {
+		if err = s.applyOnce(ops); err == nil {
+			return
+		}
+		if i >= s.cfg.MaxRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if s.cfg.OnError != nil {
+		s.cfg.OnError(ops, err)
+	} else {
+		log.Errorf("cache write behind %d ops failed: %v", len(ops), err)
+	}
+}
+
+// applyOnce BatchStore一次写入，否则逐个写入，已成功的操作重试时会再次写入
+func (s *storeCache) applyOnce(ops []StoreOp) error {
+	ctx := context.Background()
+	if b, ok := s.store.(BatchStore); ok {
+		return b.Batch(ctx, ops)
+	}
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = s.store.Delete(ctx, op.Key)
+		} else {
+			err = s.store.Save(ctx, op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
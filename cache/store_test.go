@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memStore 测试用的内存Store
+type memStore struct {
+	lock    sync.Mutex
+	data    map[string]int
+	batches [][]StoreOp
+	fails   int // 接下来写失败的次数
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string]int)}
+}
+
+func (m *memStore) Load(ctx context.Context, key string, value interface{}) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.data[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	*value.(*int) = v
+	return 0, nil
+}
+
+func (m *memStore) Save(ctx context.Context, key string, value interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.fails > 0 {
+		m.fails--
+		return errors.New("db down")
+	}
+	m.data[key] = value.(int)
+	return nil
+}
+
+func (m *memStore) Delete(ctx context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memStore) get(key string) (int, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.data[key]
+	return v, ok
+}
+
+// memBatchStore 支持批量写的memStore
+type memBatchStore struct {
+	*memStore
+}
+
+func (m memBatchStore) Batch(ctx context.Context, ops []StoreOp) error {
+	m.lock.Lock()
+	m.batches = append(m.batches, ops)
+	m.lock.Unlock()
+	for _, op := range ops {
+		if op.Delete {
+			m.Delete(ctx, op.Key)
+		} else if err := m.Save(ctx, op.Key, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWriteThrough(t *testing.T) {
+	api, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	store := newMemStore()
+	cache := WithStore(api, store, StoreConfig{})
+
+	assert.Nil(t, cache.Set("a", 1))
+	v, ok := store.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	// 写Store失败时不写cache
+	store.fails = 1
+	assert.NotNil(t, cache.Set("b", 2))
+	var value int
+	assert.Equal(t, ErrNotFound, cache.Get("b", &value))
+
+	// 未命中时通过Store加载
+	store.data["c"] = 3
+	assert.Nil(t, cache.GetWithLoad(context.Background(), "c", &value, nil))
+	assert.Equal(t, 3, value)
+
+	assert.Nil(t, cache.Delete("a"))
+	_, ok = store.get("a")
+	assert.False(t, ok)
+	assert.Equal(t, ErrNotFound, cache.Get("a", &value))
+
+	// 并发写同一个key，cache与Store一致
+	for i := 0; i < 100; i++ {
+		var wg sync.WaitGroup
+		for v := 0; v < 2; v++ {
+			wg.Add(1)
+			go func(v int) {
+				defer wg.Done()
+				cache.Set("d", v)
+			}(v)
+		}
+		wg.Wait()
+		stored, _ := store.get("d")
+		assert.Nil(t, cache.Get("d", &value))
+		assert.Equal(t, stored, value)
+	}
+	assert.Nil(t, CloseInstance(cache))
+}
+
+func TestWriteBehind(t *testing.T) {
+	api, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	store := memBatchStore{newMemStore()}
+	cache := WithStore(api, store, StoreConfig{WriteBehind: true, QueueSize: 3, BatchSize: 10, FlushInterval: time.Hour})
+	pending := cache.(interface{ Pending() int })
+
+	// 同一个key合并，队列满时返回ErrQueueFull
+	assert.Nil(t, cache.Set("a", 1))
+	assert.Nil(t, cache.Set("a", 2))
+	assert.Nil(t, cache.Delete("b"))
+	assert.Nil(t, cache.SetWithExpire("c", 3, 60))
+	assert.Equal(t, ErrQueueFull, cache.Set("d", 4))
+	assert.Equal(t, 3, pending.Pending())
+	// 入队失败时cache中也没有，写cache失败时不入队
+	var value int
+	assert.Equal(t, ErrNotFound, cache.Get("d", &value))
+	assert.Equal(t, ErrValueTooLarge, cache.Set("a", strings.Repeat("a", 2000)))
+	assert.Equal(t, 3, pending.Pending())
+
+	// 未写回的key以队列中的操作为准
+	store.data["b"] = 5
+	assert.Equal(t, ErrNotFound, cache.GetWithLoad(context.Background(), "b", &value, nil))
+	assert.Nil(t, api.Delete("a"))
+	assert.Nil(t, cache.GetWithLoad(context.Background(), "a", &value, nil))
+	assert.Equal(t, 2, value)
+
+	// Close写回剩余操作
+	assert.Nil(t, CloseInstance(cache))
+	assert.Equal(t, 0, pending.Pending())
+	assert.Equal(t, map[string]int{"a": 2, "c": 3}, store.data)
+	assert.Equal(t, [][]StoreOp{{{Key: "a", Value: 2}, {Key: "b", Delete: true}, {Key: "c", Value: 3}}}, store.batches)
+	assert.Equal(t, ErrClosed, cache.Set("e", 5))
+
+	// 满一批后台写回，失败重试
+	api, err = New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	store = memBatchStore{newMemStore()}
+	store.fails = 1
+	cache = WithStore(api, store, StoreConfig{WriteBehind: true, BatchSize: 2, FlushInterval: time.Hour,
+		RetryBackoff: time.Millisecond})
+	pending = cache.(interface{ Pending() int })
+	assert.Nil(t, cache.Set("a", 1))
+	assert.Nil(t, cache.Set("b", 2))
+	assert.Eventually(t, func() bool { return pending.Pending() == 0 }, time.Second, time.Millisecond)
+	v, _ := store.get("b")
+	assert.Equal(t, 2, v)
+	assert.Nil(t, CloseInstance(cache))
+
+	// NoRetry时失败不重试，直接回调OnError
+	api, err = New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	store = memBatchStore{newMemStore()}
+	store.fails = 1
+	failed := make(chan []StoreOp, 1)
+	cache = WithStore(api, store, StoreConfig{WriteBehind: true, BatchSize: 1, FlushInterval: time.Hour,
+		MaxRetries: NoRetry, OnError: func(ops []StoreOp, err error) { failed <- ops }})
+	assert.Nil(t, cache.Set("a", 1))
+	assert.Equal(t, []StoreOp{{Key: "a", Value: 1}}, <-failed)
+	assert.Nil(t, CloseInstance(cache))
+	_, ok := store.get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(store.batches))
+}
@@ -3,18 +3,21 @@ package cache
 
 import (
 	"context"
+	"io"
 	"reflect"
 	"sync"
+	"time"
 	"unsafe"
 
 	"git.code.oa.com/video_pay_root/pay-go-comm/utils/parallel"
-	"golang.org/x/sync/singleflight"
 )
 
 // Constructor cache实例构造函数
 type Constructor func(cfg *Config) (API, error)
 
-// LoadFunc 加载key对应的value数据，用于填充cache
+// LoadFunc 加载key对应的value数据，用于填充cache。value是与GetWithLoad传入的value同类型的新对象(零值)，
+// 而不是调用方传入的对象，不能依赖其中已有的数据；加载结果浅拷贝给合并到这次加载的每个调用方，
+// 调用方之间共享其中的指针、map、slice
 type LoadFunc func(ctx context.Context, key string, value interface{}) (ttl int64, err error)
 
 // API 接口抽象
@@ -35,6 +38,144 @@ type API interface {
 	GetStats() Stats
 }
 
+// 以下为可选接口，内置引擎均已实现，自定义引擎按需实现。实例被中间件等包装时，
+// 通过CloseInstance/ResizeInstance等函数调用，逐层查找第一个实现了对应接口的实例
+
+// StatsResetter 可以重置统计数据的cache实例
+type StatsResetter interface {
+	// ResetStats 重置统计数据
+	ResetStats()
+}
+
+// WindowStatser 提供滑动窗口统计数据的cache实例
+type WindowStatser interface {
+	// GetWindowStats 获取最近window时间内的统计数据，最长MaxStatsWindow
+	GetWindowStats(window time.Duration) WindowStats
+}
+
+// Resizer 支持运行时调整内存上限的cache实例
+type Resizer interface {
+	// Resize 运行时调整cache占用的最大内存，单位MB，不支持时返回ErrNotSupported
+	Resize(newSizeInMB int) error
+}
+
+// CapabilityReporter 可以查询支持哪些可选特性的cache实例
+type CapabilityReporter interface {
+	// Capabilities 返回实例支持的可选特性
+	Capabilities() Capability
+}
+
+// EngineNamer 可以查询引擎名的cache实例
+type EngineNamer interface {
+	// Engine 返回构造实例时的引擎名，如EngineFreeCache
+	Engine() string
+}
+
+// RawGetter 支持读取key原始数据的cache实例，bigcache/freecache/fastcache已实现，用于排查问题
+type RawGetter interface {
+	// GetRaw 返回key对应的序列化(及压缩)后的数据，不存在返回ErrNotFound，不计入统计数据
+	GetRaw(key string) ([]byte, error)
+}
+
+// ValueSizeLimiter 可以查询单个value大小上限的cache实例，所有引擎已实现。
+// value超过上限时Set/SetWithExpire返回ErrValueTooLarge，GetWithLoad不回填
+type ValueSizeLimiter interface {
+	// MaxValueSize 返回key对应的value序列化后(localcache为Sizer估算值)允许的最大字节数
+	MaxValueSize(key string) int
+}
+
+// MaxValueSize 返回实例中key对应value的大小上限，穿透中间件等包装；实例未实现ValueSizeLimiter时返回false
+func MaxValueSize(api API, key string) (int, bool) {
+	if l, ok := Unwrap(api).(ValueSizeLimiter); ok {
+		return l.MaxValueSize(key), true
+	}
+	return 0, false
+}
+
+// CloseInstance 关闭实例(io.Closer)，停止后台任务并释放内存，关闭后其他接口返回ErrClosed；实例未实现时返回nil
+func CloseInstance(api API) error {
+	for _, layer := range layers(api) {
+		if c, ok := layer.(io.Closer); ok {
+			return c.Close()
+		}
+	}
+	return nil
+}
+
+// ResizeInstance 运行时调整实例占用的最大内存，单位MB；实例未实现Resizer时返回ErrNotSupported
+func ResizeInstance(api API, newSizeInMB int) error {
+	for _, layer := range layers(api) {
+		if r, ok := layer.(Resizer); ok {
+			return r.Resize(newSizeInMB)
+		}
+	}
+	return ErrNotSupported
+}
+
+// ResetInstanceStats 重置实例的统计数据；实例未实现StatsResetter时不做处理
+func ResetInstanceStats(api API) {
+	for _, layer := range layers(api) {
+		if r, ok := layer.(StatsResetter); ok {
+			r.ResetStats()
+			return
+		}
+	}
+}
+
+// GetInstanceWindowStats 获取实例最近window时间内的统计数据；实例未实现WindowStatser时返回空数据
+func GetInstanceWindowStats(api API, window time.Duration) WindowStats {
+	for _, layer := range layers(api) {
+		if w, ok := layer.(WindowStatser); ok {
+			return w.GetWindowStats(window)
+		}
+	}
+	return WindowStats{}
+}
+
+// GetInstanceCapabilities 返回实例支持的可选特性；实例未实现CapabilityReporter时返回0
+func GetInstanceCapabilities(api API) Capability {
+	for _, layer := range layers(api) {
+		if r, ok := layer.(CapabilityReporter); ok {
+			return r.Capabilities()
+		}
+	}
+	return 0
+}
+
+// GetInstanceEngine 返回实例的引擎名；实例未实现EngineNamer时返回空
+func GetInstanceEngine(api API) string {
+	for _, layer := range layers(api) {
+		if n, ok := layer.(EngineNamer); ok {
+			return n.Engine()
+		}
+	}
+	return ""
+}
+
+// layers 返回实例及其逐层包装的实例，由外到内
+func layers(api API) []API {
+	list := []API{api}
+	for {
+		w, ok := api.(interface{ Unwrap() API })
+		if !ok {
+			return list
+		}
+		api = w.Unwrap()
+		list = append(list, api)
+	}
+}
+
+// Unwrap 返回被中间件等包装(实现了Unwrap() API)的原始实例，没有包装时原样返回
+func Unwrap(api API) API {
+	for {
+		w, ok := api.(interface{ Unwrap() API })
+		if !ok {
+			return api
+		}
+		api = w.Unwrap()
+	}
+}
+
 // Serializer 用于value序列化的接口
 type Serializer interface {
 	Unmarshal(in []byte, body interface{}) error
@@ -44,7 +185,6 @@ type Serializer interface {
 var (
 	lock         = sync.RWMutex{}
 	cacheEngines = make(map[string]Constructor)
-	group        = &singleflight.Group{}
 )
 
 // New 构造函数
@@ -52,7 +192,7 @@ func New(engine string, maxSizeInMB int, opts ...Option) (API, error) {
 	parallel.GoRun(func() {
 		report(engine)
 	})
-	cfg := &Config{MaxSizeInMB: maxSizeInMB}
+	cfg := &Config{Engine: engine, MaxSizeInMB: maxSizeInMB}
 	for _, opt := range opts {
 		opt(cfg)
 	}
@@ -85,26 +225,3 @@ func str2bytes(s string) (b []byte) {
 	bh.Data, bh.Len, bh.Cap = sh.Data, sh.Len, sh.Len
 	return b
 }
-
-// getWithLoad key如果不存在，实时加载
-func getWithLoad(ctx context.Context, cache API, key string, value interface{}, load LoadFunc) (hit bool, err error) {
-	if err := cache.Get(key, value); err == nil {
-		return true, nil
-	}
-	// 不存在，则重新获取；使用singleflight防止并发获取
-	if _, err, _ := group.Do(key, func() (interface{}, error) {
-		ttl, err := load(ctx, key, value)
-		if err != nil {
-			return nil, err
-		}
-		if ttl > 0 {
-			cache.SetWithExpire(key, value, ttl)
-		} else {
-			cache.Set(key, value)
-		}
-		return nil, err
-	}); err != nil {
-		return false, err
-	}
-	return false, nil
-}
@@ -2,11 +2,21 @@ package cache
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"git.code.oa.com/trpc-go/trpc-go"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 const (
@@ -115,3 +125,771 @@ func TestNewLocalCache(t *testing.T) {
 
 	testFunc(t, cache, 3)
 }
+
+func resetDefault() {
+	defaultCache, defaultErr, defaultUsed, once = nil, nil, false, sync.Once{}
+	defaultNew = func() (API, error) { return New(EngineFreeCache, defaultSize) }
+}
+
+func TestConfigureDefault(t *testing.T) {
+	defer resetDefault()
+
+	// 第一次使用前，统计、调整大小和关闭不会构造默认实例
+	resetDefault()
+	assert.Equal(t, Stats{}, GetStats())
+	assert.Equal(t, ErrNotInitialized, Resize(1))
+	assert.Nil(t, Close())
+	assert.False(t, defaultUsed)
+	assert.Nil(t, defaultCache)
+
+	// 构造失败的错误透传给调用方
+	resetDefault()
+	assert.Nil(t, ConfigureDefault("xxx", 1))
+	assert.Equal(t, ErrNoSuchEngine, Set(keyNumber, 1))
+	assert.Equal(t, Stats{}, GetStats())
+	assert.Equal(t, ErrDefaultInUse, ConfigureDefault(EngineFastCache, 1))
+
+	// 使用前可以替换默认实例
+	resetDefault()
+	c, err := New(EngineFastCache, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, SetDefault(c))
+	assert.Nil(t, Set(keyNumber, 1))
+	var numVal int
+	assert.Nil(t, c.Get(keyNumber, &numVal))
+	assert.Equal(t, 1, numVal)
+	assert.Equal(t, ErrDefaultInUse, SetDefault(c))
+}
+
+func TestClose(t *testing.T) {
+	for _, engine := range []string{EngineBigCache, EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		before := runtime.NumGoroutine()
+		for i := 0; i < 10; i++ {
+			cache, err := New(engine, 1, WithDefaultTTL(1))
+			assert.Nil(t, err)
+			assert.Nil(t, CloseInstance(cache))
+			assert.Equal(t, ErrClosed, CloseInstance(cache))
+			assert.Equal(t, ErrClosed, cache.Set(keyNumber, 1))
+			var numVal int
+			assert.Equal(t, ErrClosed, cache.Get(keyNumber, &numVal))
+			assert.Equal(t, ErrClosed, cache.GetWithLoad(trpc.BackgroundContext(), keyNumber, &numVal, getLoadFunc(1)))
+			assert.Equal(t, ErrClosed, cache.Delete(keyNumber))
+			assert.Equal(t, ErrClosed, cache.Clear())
+		}
+		// 后台协程退出需要一点时间，等待协程数回落
+		deadline := time.Now().Add(3 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.LessOrEqual(t, runtime.NumGoroutine(), before, engine)
+	}
+}
+
+func TestBytesUsed(t *testing.T) {
+	// bigcache和freecache无法获取实际占用，不提供BytesUsed
+	for engine, supported := range map[string]bool{EngineBigCache: false, EngineFreeCache: false,
+		EngineFastCache: true, EngineLocalCache: true} {
+		cache, err := New(engine, 1)
+		assert.Nil(t, err, engine)
+		assert.Nil(t, cache.Set(keyNumber, 1), engine)
+		assert.Equal(t, supported, GetInstanceCapabilities(cache).Has(CapBytesUsed), engine)
+		assert.Equal(t, supported, cache.GetStats().BytesUsed > 0, engine)
+		CloseInstance(cache)
+	}
+}
+
+func TestResize(t *testing.T) {
+	for _, engine := range []string{EngineBigCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1)
+		assert.Nil(t, err)
+		assert.False(t, GetInstanceCapabilities(cache).Has(CapResize))
+		assert.Equal(t, ErrNotSupported, ResizeInstance(cache, 2))
+	}
+
+	cache, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	assert.True(t, GetInstanceCapabilities(cache).Has(CapResize|CapPerKeyTTL))
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, cache.SetWithExpire(fmt.Sprint(i), i, 100))
+	}
+	assert.Nil(t, ResizeInstance(cache, 2))
+	// 迁移期间可以正常读写
+	assert.Nil(t, cache.Set(keyNumber, 1))
+	assert.Nil(t, cache.Delete("0"))
+	var numVal int
+	for i := 1; i < 1000; i++ {
+		assert.Nil(t, cache.Get(fmt.Sprint(i), &numVal))
+		assert.Equal(t, i, numVal)
+	}
+
+	impl := cache.(*freecacheImpl)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		impl.lock.RLock()
+		done := impl.old == nil
+		impl.lock.RUnlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, impl.cfg.MaxSizeInMB) // 不修改共享的配置
+	resized, _ := New(EngineFreeCache, 2)
+	want, _ := MaxValueSize(resized, "k")
+	limit, _ := MaxValueSize(cache, "k")
+	assert.Equal(t, want, limit)
+	assert.Equal(t, int64(1000), impl.cache.EntryCount())
+	assert.Equal(t, ErrNotFound, cache.Get("0", &numVal))
+	ttl, err := impl.cache.TTL([]byte("999"))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 90)
+
+	// Close等待迁移协程退出
+	assert.Nil(t, ResizeInstance(cache, 1))
+	assert.Nil(t, CloseInstance(cache))
+	assert.Nil(t, impl.old)
+	assert.Equal(t, ErrClosed, ResizeInstance(cache, 2))
+}
+
+func TestLocalCacheBytesBudget(t *testing.T) {
+	cache, err := New(EngineLocalCache, 1)
+	assert.Nil(t, err)
+
+	value := make([]byte, 20*1024)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, cache.Set(fmt.Sprint(i), value))
+	}
+	stats := cache.GetStats()
+	assert.True(t, stats.BytesUsed <= 1024*1024)
+	assert.True(t, stats.EntryCount < 100 && stats.EntryCount > 40)
+	// 最早写入的key被淘汰，最近写入的保留
+	var bytesVal []byte
+	assert.Equal(t, ErrNotFound, cache.Get("0", &bytesVal))
+	assert.Nil(t, cache.Get("99", &bytesVal))
+
+	assert.Equal(t, ErrValueTooLarge, cache.Set(keyBytes, make([]byte, 2*1024*1024)))
+	assert.Nil(t, cache.Delete("99"))
+	assert.Equal(t, stats.EntryCount-1, cache.GetStats().EntryCount)
+	assert.Nil(t, cache.Clear())
+	assert.Equal(t, int64(0), cache.GetStats().BytesUsed)
+
+	// 自定义Sizer
+	cache, err = New(EngineLocalCache, 1, WithSizer(func(value interface{}) int { return 512 * 1024 }))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, cache.Set(fmt.Sprint(i), i))
+	}
+	assert.Equal(t, int64(1), cache.GetStats().EntryCount)
+}
+
+func TestEstimateSize(t *testing.T) {
+	type item struct {
+		Name string
+		Tags []string
+		next *item
+	}
+	assert.Equal(t, 8, estimateSize(int64(1)))
+	assert.Equal(t, 16+3, estimateSize("foo"))
+	assert.Equal(t, 24+100, estimateSize(make([]byte, 100)))
+	loop := &item{Name: "foo", Tags: []string{"a", "b"}}
+	loop.next = loop
+	size := estimateSize(loop)
+	assert.Equal(t, 8+int(reflect.TypeOf(item{}).Size())+3+2*16+2, size)
+}
+
+type clonedStats struct {
+	Stats
+	cloned bool
+}
+
+func (s *clonedStats) Clone() interface{} {
+	return &clonedStats{Stats: s.Stats, cloned: true}
+}
+
+func TestLocalCacheCopyPolicy(t *testing.T) {
+	// 默认不拷贝，修改会影响cache中的数据
+	cache, err := New(EngineLocalCache, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Set(keyBytes, []string{"a"}))
+	var sliceVal []string
+	assert.Nil(t, cache.Get(keyBytes, &sliceVal))
+	sliceVal[0] = "b"
+	assert.Nil(t, cache.Get(keyBytes, &sliceVal))
+	assert.Equal(t, []string{"b"}, sliceVal)
+
+	for _, policy := range []CopyPolicy{CopyClone, CopySerialize} {
+		cache, err := New(EngineLocalCache, 1, WithCopyPolicy(policy))
+		assert.Nil(t, err)
+		origin := []string{"a"}
+		assert.Nil(t, cache.Set(keyBytes, origin))
+		origin[0] = "x"
+		var sliceVal []string
+		assert.Nil(t, cache.Get(keyBytes, &sliceVal))
+		sliceVal[0] = "b"
+		assert.Nil(t, cache.Get(keyBytes, &sliceVal))
+		assert.Equal(t, []string{"a"}, sliceVal)
+	}
+
+	// 优先使用Cloner
+	cache, err = New(EngineLocalCache, 1, WithCopyPolicy(CopyClone))
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Set(keyStruct, &clonedStats{Stats: Stats{Hits: 1}}))
+	var structVal *clonedStats
+	assert.Nil(t, cache.Get(keyStruct, &structVal))
+	assert.True(t, structVal.cloned)
+	assert.Equal(t, int64(1), structVal.Hits)
+}
+
+func TestLocalCacheMutationCheck(t *testing.T) {
+	cache, err := New(EngineLocalCache, 1, WithMutationCheck(true))
+	assert.Nil(t, err)
+	value := map[string]int{"a": 1}
+	assert.Nil(t, cache.Set(keyStruct, value))
+	var mapVal map[string]int
+	assert.Nil(t, cache.Get(keyStruct, &mapVal))
+	mapVal["a"] = 2
+	assert.Equal(t, ErrValueMutated, cache.Get(keyStruct, &mapVal))
+	assert.Equal(t, ErrNotFound, cache.Get(keyStruct, &mapVal))
+}
+
+func TestStats(t *testing.T) {
+	loadErr := errors.New("load error")
+	for _, engine := range []string{EngineBigCache, EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1)
+		assert.Nil(t, err)
+		// 没有任何调用时命中率为0
+		assert.Equal(t, float64(0), cache.GetStats().HitRate, engine)
+
+		assert.Nil(t, cache.Set(keyNumber, 1))
+		assert.Nil(t, cache.Set(keyString, "ok"))
+		assert.Nil(t, cache.Delete(keyString))
+		var strVal string
+		err = cache.GetWithLoad(trpc.BackgroundContext(), keyLoadError, &strVal,
+			func(ctx context.Context, key string, value interface{}) (int64, error) {
+				time.Sleep(2 * time.Millisecond)
+				return 0, loadErr
+			})
+		assert.Equal(t, loadErr, err)
+
+		stats := cache.GetStats()
+		assert.Equal(t, int64(2), stats.Sets, engine)
+		assert.Equal(t, int64(1), stats.Deletes, engine)
+		assert.Equal(t, int64(1), stats.Loads, engine)
+		assert.Equal(t, int64(1), stats.LoadErrors, engine)
+		assert.Equal(t, int64(1), stats.Misses, engine)
+		assert.True(t, stats.LoadDurationP99 >= 2*time.Millisecond, engine)
+		assert.True(t, stats.EntryCount >= 1, engine)
+
+		ResetInstanceStats(cache)
+		stats = cache.GetStats()
+		assert.Equal(t, int64(0), stats.Sets+stats.Deletes+stats.Loads+stats.LoadErrors+stats.Misses, engine)
+		assert.Equal(t, time.Duration(0), stats.LoadDurationP50, engine)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for i := 0; i < 90; i++ {
+		h.observe(50 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(3 * time.Millisecond)
+	}
+	assert.Equal(t, 100*time.Microsecond, h.percentile(0.5))
+	assert.Equal(t, 100*time.Microsecond, h.percentile(0.9))
+	assert.Equal(t, 3200*time.Microsecond, h.percentile(0.99))
+	h.observe(time.Hour)
+	assert.Equal(t, histogramMinBound<<(histogramBuckets-1), h.percentile(1))
+}
+
+func TestWindowStats(t *testing.T) {
+	cache, err := New(EngineFastCache, 1)
+	assert.Nil(t, err)
+	var numVal int
+	assert.Nil(t, cache.Set(keyNumber, 1))
+	assert.Nil(t, cache.Get(keyNumber, &numVal))
+	assert.Equal(t, ErrNotFound, cache.Get(keyString, &numVal))
+
+	stats := GetInstanceWindowStats(cache, time.Minute)
+	assert.Equal(t, time.Minute, stats.Window)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, 0.5, stats.HitRate)
+
+	// 模拟100秒前的数据，只在更长的窗口内可见
+	w := &cache.(*fastcacheImpl).stats.window
+	epoch := time.Now().UnixNano()/int64(windowBucketWidth) - 20
+	old := &w.buckets[epoch%int64(windowBuckets)]
+	old.epoch, old.hits = epoch, 10
+	assert.Equal(t, int64(1), GetInstanceWindowStats(cache, time.Minute).Hits)
+	assert.Equal(t, int64(11), GetInstanceWindowStats(cache, 5*time.Minute).Hits)
+	assert.Equal(t, MaxStatsWindow, GetInstanceWindowStats(cache, time.Hour).Window)
+
+	ResetInstanceStats(cache)
+	assert.Equal(t, int64(0), GetInstanceWindowStats(cache, MaxStatsWindow).Hits)
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(provider)
+
+	cache, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		close(started)
+		<-release
+		*value.(*string) = "value"
+		return 0, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var value string
+			assert.Nil(t, cache.GetWithLoad(ctx, keyString, &value, load))
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // 等待第二个协程进入singleflight
+	close(release)
+	wg.Wait()
+	var value string
+	assert.Nil(t, cache.GetWithLoad(ctx, keyString, &value, load))
+	parent.End()
+
+	var getSpans []sdktrace.ReadOnlySpan
+	var loadSpan sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "cache.GetWithLoad":
+			assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+			getSpans = append(getSpans, span)
+		case "cache.LoadFunc":
+			loadSpan = span
+		}
+	}
+	assert.Equal(t, 3, len(getSpans))
+	assert.NotNil(t, loadSpan)
+	var hits, deduped int
+	for _, span := range getSpans {
+		for _, attr := range span.Attributes() {
+			switch {
+			case attr.Key == attrHit && attr.Value.AsBool():
+				hits++
+			case attr.Key == attrDeduped && attr.Value.AsBool():
+				deduped++
+			case attr.Key == attrDeduped:
+				// 执行LoadFunc的span是LoadFunc span的父span
+				assert.Equal(t, span.SpanContext().SpanID(), loadSpan.Parent().SpanID())
+			}
+		}
+	}
+	assert.Equal(t, 1, hits)
+	assert.Equal(t, 1, deduped)
+}
+
+func TestTTLJitter(t *testing.T) {
+	defer func(f func() float64) { jitterRand = f }(jitterRand)
+	r := 0.0
+	jitterRand = func() float64 { return r }
+
+	b := newBase(&Config{TTLJitter: 0.1})
+	assert.Equal(t, int64(90), b.jitter(100))
+	r = 0.5
+	assert.Equal(t, int64(100), b.jitter(100))
+	r = 0.99
+	assert.Equal(t, int64(109), b.jitter(100))
+	assert.Equal(t, int64(0), b.jitter(0))
+	r = 0
+	assert.Equal(t, int64(1), newBase(&Config{TTLJitter: 1}).jitter(100))
+
+	_, err := New(EngineBigCache, 1, WithTTLJitter(0.1))
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+
+	// Set默认过期时间、SetWithExpire和LoadFunc返回的过期时间均浮动
+	cache, err := New(EngineFreeCache, 1, WithDefaultTTL(100), WithTTLJitter(0.2))
+	assert.Nil(t, err)
+	fc := cache.(*freecacheImpl).cache
+	assert.Nil(t, cache.Set("a", 1))
+	ttl, _ := fc.TTL([]byte("a"))
+	assert.InDelta(t, 80, ttl, 1) // 跨秒时可能少1秒
+	assert.Nil(t, cache.SetWithExpire("b", 1, 50))
+	ttl, _ = fc.TTL([]byte("b"))
+	assert.InDelta(t, 40, ttl, 1)
+	var value int
+	assert.Nil(t, cache.GetWithLoad(context.Background(), "c", &value, getLoadFunc(10)))
+	ttl, _ = fc.TTL([]byte("c"))
+	assert.InDelta(t, 8, ttl, 1)
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	defer func(f func() float64) { xfetchRand = f }(xfetchRand)
+	for _, engine := range []string{EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1, WithEarlyRefresh(1))
+		assert.Nil(t, err)
+		// 10秒后过期，上次加载耗时2秒
+		assert.Nil(t, cache.(entryStore).setEntry("k", 1, 10, 2*time.Second))
+		loads := 0
+		load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+			loads++
+			if loads > 1 {
+				*value.(*int) = -1 // 失败时也可能修改了value
+				return 0, errors.New("load failed")
+			}
+			*value.(*int) = 2
+			return 10, nil
+		}
+
+		// 2*beta*-ln(0.5)约1.4秒，离过期还早，不刷新
+		xfetchRand = func() float64 { return 0.5 }
+		var value int
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, load), engine)
+		assert.Equal(t, 1, value, engine)
+		assert.Equal(t, 0, loads, engine)
+
+		// 2*beta*-ln(1e-10)约46秒，提前刷新
+		xfetchRand = func() float64 { return 1e-10 }
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, load), engine)
+		assert.Equal(t, 2, value, engine)
+		assert.Equal(t, 1, loads, engine)
+		meta, err := cache.(entryStore).getEntry("k", &value, false)
+		assert.Nil(t, err)
+		assert.True(t, meta.delta > 0 && meta.delta < time.Second, engine)
+
+		// 刚加载完，耗时很短，不刷新
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, load), engine)
+		assert.Equal(t, 1, loads, engine)
+
+		// 提前刷新失败时返回缓存的数据
+		assert.Nil(t, cache.(entryStore).setEntry("k", 3, 10, 2*time.Second))
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, load), engine)
+		assert.Equal(t, 3, value, engine)
+		assert.Equal(t, 2, loads, engine)
+		assert.Equal(t, int64(2), cache.GetStats().EarlyRefreshes, engine)
+		assert.Equal(t, int64(1), cache.GetStats().LoadErrors, engine)
+	}
+}
+
+// expireAll 将entry的时钟调快3秒，使1秒后过期的key过期
+func expireAll() func() {
+	clock = func() time.Time { return time.Now().Add(3 * time.Second) }
+	return func() { clock = time.Now }
+}
+
+func TestStaleIfError(t *testing.T) {
+	for _, engine := range []string{EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1, WithStaleIfError(60))
+		assert.Nil(t, err)
+		assert.Nil(t, cache.SetWithExpire("k", 1, 1))
+		restore := expireAll()
+		var value int
+		assert.Equal(t, ErrNotFound, cache.Get("k", &value), engine)
+
+		fail := func(ctx context.Context, key string, value interface{}) (int64, error) {
+			*value.(*int) = -1
+			return 0, errors.New("db down")
+		}
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, fail), engine)
+		assert.Equal(t, 1, value, engine)
+		assert.Equal(t, int64(1), cache.GetStats().StaleHits, engine)
+		// 没有过期数据的key返回加载错误
+		assert.NotNil(t, cache.GetWithLoad(context.Background(), "x", &value, fail), engine)
+
+		// 加载成功后正常返回新数据
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, getLoadFunc(10)), engine)
+		assert.Nil(t, cache.Get("k", &value), engine)
+		restore()
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cache, err := New(EngineFreeCache, 1, WithStaleIfError(60), WithCircuitBreaker(2, time.Minute))
+	assert.Nil(t, err)
+	b := cache.(*freecacheImpl).breaker
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	loads := 0
+	var loadErr error
+	load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		loads++
+		*value.(*int) = 2
+		return 0, loadErr
+	}
+	var value int
+	loadErr = errors.New("db down")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, loadErr, cache.GetWithLoad(context.Background(), "k", &value, load))
+	}
+	assert.Equal(t, BreakerOpen, cache.GetStats().BreakerState)
+	assert.Equal(t, int64(1), cache.GetStats().BreakerOpens)
+
+	// 熔断中不调用LoadFunc，有过期数据时返回过期数据
+	assert.Equal(t, ErrCircuitOpen, cache.GetWithLoad(context.Background(), "k", &value, load))
+	assert.Nil(t, cache.SetWithExpire("stale", 1, 1))
+	restore := expireAll()
+	assert.Nil(t, cache.GetWithLoad(context.Background(), "stale", &value, load))
+	assert.Equal(t, 1, value)
+	restore()
+	assert.Equal(t, 2, loads)
+	assert.Equal(t, int64(2), cache.GetStats().LoadErrors)
+
+	// 冷却结束后放行一次试探调用，失败重新熔断
+	now = now.Add(time.Minute)
+	assert.Equal(t, loadErr, cache.GetWithLoad(context.Background(), "k", &value, load))
+	assert.Equal(t, 3, loads)
+	assert.Equal(t, BreakerOpen, cache.GetStats().BreakerState)
+	assert.Equal(t, int64(2), cache.GetStats().BreakerOpens)
+
+	// 试探成功后恢复
+	now = now.Add(time.Minute)
+	loadErr = nil
+	assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, load))
+	assert.Equal(t, 2, value)
+	assert.Equal(t, BreakerClosed, cache.GetStats().BreakerState)
+}
+
+func TestLoadCancellation(t *testing.T) {
+	cache, err := New(EngineFreeCache, 1, WithMaxConcurrentLoads(1))
+	assert.Nil(t, err)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var loads int32
+	load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		atomic.AddInt32(&loads, 1)
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		*value.(*int) = 7
+		return 0, nil
+	}
+
+	// 调用方ctx取消后直接返回，共享的加载继续执行并写入cache
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		var value int
+		done <- cache.GetWithLoad(ctx, "k", &value, load)
+	}()
+	<-started
+	waiter := make(chan int)
+	go func() {
+		var value int
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, load))
+		waiter <- value
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	close(release)
+	assert.Equal(t, 7, <-waiter)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+	var value int
+	assert.Nil(t, cache.Get("k", &value))
+	assert.Equal(t, 7, value)
+
+	// 加载超时，排队等待也计入超时
+	cache, err = New(EngineFreeCache, 1, WithLoadTimeout(50*time.Millisecond), WithMaxConcurrentLoads(1))
+	assert.Nil(t, err)
+	release = make(chan struct{})
+	block := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		started <- struct{}{}
+		<-release
+		return 0, ctx.Err()
+	}
+	go cache.GetWithLoad(context.Background(), "a", new(int), block)
+	<-started
+	assert.Equal(t, context.DeadlineExceeded, cache.GetWithLoad(context.Background(), "b", &value, load))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+	close(release)
+}
+
+func TestLoadPanic(t *testing.T) {
+	for _, engine := range []string{EngineBigCache, EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1, WithMaxConcurrentLoads(1), WithCircuitBreaker(2, time.Minute))
+		assert.Nil(t, err, engine)
+		release := make(chan struct{})
+		started := make(chan struct{})
+		load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+			close(started)
+			<-release
+			panic("boom")
+		}
+		// 所有等待的调用方都收到错误
+		errs := make(chan error, 3)
+		go func() { errs <- cache.GetWithLoad(context.Background(), keyNumber, new(int), load) }()
+		<-started
+		for i := 0; i < 2; i++ {
+			go func() { errs <- cache.GetWithLoad(context.Background(), keyNumber, new(int), load) }()
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		for i := 0; i < 3; i++ {
+			assert.True(t, errors.Is(<-errs, ErrLoadPanic), engine)
+		}
+		// 并发名额和租约已释放，熔断器记录一次失败
+		var value int
+		assert.Nil(t, cache.GetWithLoad(context.Background(), keyNumber, &value, getLoadFunc(0)), engine)
+		assert.Equal(t, 1, value, engine)
+		value = 0
+		assert.Nil(t, cache.Get(keyNumber, &value), engine)
+		assert.Equal(t, 1, value, engine)
+		stats := cache.GetStats()
+		assert.Equal(t, int64(1), stats.LoadErrors, engine)
+		assert.Equal(t, BreakerClosed, stats.BreakerState, engine)
+		CloseInstance(cache)
+	}
+}
+
+func TestLease(t *testing.T) {
+	for _, engine := range []string{EngineBigCache, EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1)
+		assert.Nil(t, err, engine)
+		// 加载期间执行write，回填是否被丢弃
+		fill := func(write func()) (int, error) {
+			load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+				write()
+				*value.(*int) = 1
+				return 0, nil
+			}
+			var value int
+			assert.Nil(t, cache.GetWithLoad(context.Background(), "k", &value, load), engine)
+			assert.Equal(t, 1, value, engine)
+			value = 0
+			err := cache.Get("k", &value)
+			return value, err
+		}
+
+		value, err := fill(func() {})
+		assert.Nil(t, err, engine)
+		assert.Equal(t, 1, value, engine)
+		assert.Nil(t, cache.Delete("k"))
+
+		_, err = fill(func() { cache.Delete("k") })
+		assert.Equal(t, ErrNotFound, err, engine)
+		value, err = fill(func() { cache.Set("k", 2) })
+		assert.Nil(t, err, engine)
+		assert.Equal(t, 2, value, engine)
+		assert.Nil(t, cache.Delete("k"))
+		_, err = fill(func() { cache.Clear() })
+		assert.Equal(t, ErrNotFound, err, engine)
+		assert.Equal(t, int64(3), cache.GetStats().LeaseDrops, engine)
+
+		// 回填使用LoadFunc返回的ttl，bigcache忽略ttl
+		var numVal int
+		assert.Nil(t, cache.GetWithLoad(context.Background(), keyNumber, &numVal, getLoadFunc(10)), engine)
+		numVal = 0
+		assert.Nil(t, cache.Get(keyNumber, &numVal), engine)
+		assert.Equal(t, 1, numVal, engine)
+		// 回填失败仍返回加载结果
+		limit, _ := MaxValueSize(cache, "big")
+		var strVal string
+		assert.Nil(t, cache.GetWithLoad(context.Background(), "big", &strVal, bigLoad(limit+1)), engine)
+		assert.Equal(t, int64(1), cache.GetStats().FillErrors, engine)
+		CloseInstance(cache)
+	}
+}
+
+func TestLeaseFill(t *testing.T) {
+	l := newLeases()
+	var undone []string
+	undo := func(key string) func() { return func() { undone = append(undone, key) } }
+
+	token := l.acquire("a")
+	filled, err := l.fill("a", token, func() error { return nil }, undo("a"))
+	assert.True(t, filled)
+	assert.Nil(t, err)
+	// 租约已收回
+	filled, _ = l.fill("a", token, func() error { return nil }, undo("a"))
+	assert.False(t, filled)
+
+	// 写入时不持有锁，写入期间的失效、清空和新的加载使回填被撤销
+	for _, invalidate := range []func(key string){
+		l.invalidate,
+		func(string) { l.invalidateAll() },
+		func(key string) { l.acquire(key) },
+	} {
+		token = l.acquire("b")
+		filled, err = l.fill("b", token, func() error {
+			invalidate("b")
+			return nil
+		}, undo("b"))
+		assert.False(t, filled)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"b", "b", "b"}, undone)
+
+	// 写入失败时不撤销，收回租约
+	token = l.acquire("c")
+	filled, err = l.fill("c", token, func() error { return ErrValueTooLarge }, undo("c"))
+	assert.True(t, filled)
+	assert.Equal(t, ErrValueTooLarge, err)
+	assert.False(t, l.valid("c", token, false))
+}
+
+func TestDecodeError(t *testing.T) {
+	for _, engine := range []string{EngineBigCache, EngineFreeCache, EngineFastCache, EngineLocalCache} {
+		cache, err := New(engine, 1, WithSerializer(corruptSerializer{jsoniter.ConfigCompatibleWithStandardLibrary}))
+		assert.Nil(t, err, engine)
+		// 读取目标类型不匹配时保留entry，正确的类型仍可以读取
+		assert.Nil(t, cache.Set(keyNumber, "not a number"))
+		var numVal int
+		err = cache.Get(keyNumber, &numVal)
+		assert.True(t, errors.Is(err, ErrCannotSet), engine)
+		assert.False(t, errors.Is(err, ErrDecode), engine)
+		var strVal string
+		assert.True(t, errors.Is(cache.Get(keyNumber, strVal), ErrCannotSet), engine)
+		assert.Nil(t, cache.Get(keyNumber, &strVal), engine)
+		assert.Equal(t, "not a number", strVal, engine)
+
+		// GetWithLoad重新加载并回填
+		assert.Nil(t, cache.GetWithLoad(context.Background(), keyNumber, &numVal, getLoadFunc(0)), engine)
+		assert.Equal(t, 1, numVal, engine)
+		numVal = 0
+		assert.Nil(t, cache.Get(keyNumber, &numVal), engine)
+		assert.Equal(t, 1, numVal, engine)
+		stats := cache.GetStats()
+		assert.Equal(t, int64(0), stats.DecodeErrors, engine)
+		assert.Equal(t, int64(1), stats.Loads, engine)
+		assert.Equal(t, int64(2), stats.Hits, engine)
+		if engine == EngineLocalCache {
+			CloseInstance(cache)
+			continue // 保存的是对象，不会损坏
+		}
+
+		// 数据损坏时删除entry
+		assert.Nil(t, cache.Set(keyNumber, corruptValue))
+		err = cache.Get(keyNumber, &numVal)
+		assert.True(t, errors.Is(err, ErrDecode), engine)
+		var decodeErr *DecodeError
+		assert.True(t, errors.As(err, &decodeErr), engine)
+		assert.Equal(t, engine, decodeErr.Engine)
+		assert.Equal(t, keyNumber, decodeErr.Key)
+		assert.Equal(t, ErrNotFound, cache.Get(keyNumber, &strVal), engine)
+		assert.Equal(t, int64(1), cache.GetStats().DecodeErrors, engine)
+		CloseInstance(cache)
+	}
+}
+
+// corruptValue 通过corruptSerializer写入时保存为无法解析的数据
+const corruptValue = "corrupt"
+
+type corruptSerializer struct {
+	Serializer
+}
+
+func (s corruptSerializer) Marshal(body interface{}) ([]byte, error) {
+	if body == corruptValue {
+		return []byte("{"), nil
+	}
+	return s.Serializer.Marshal(body)
+}
@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName OpenTelemetry tracer名，未通过otel.SetTracerProvider设置全局TracerProvider时不产生span
+const tracerName = "git.code.oa.com/video_pay_root/pay-go-comm/tcache/cache"
+
+// span属性定义
+const (
+	attrEngine  = attribute.Key("tcache.engine")
+	attrHit     = attribute.Key("tcache.hit")
+	attrDeduped = attribute.Key("tcache.deduped") // 本次加载是否与其他协程合并，由其他协程执行LoadFunc
+	// attrEarlyRefresh 命中但按XFetch算法提前刷新
+	attrEarlyRefresh = attribute.Key("tcache.early_refresh")
+	// attrStale 加载失败，返回了过期数据
+	attrStale = attribute.Key("tcache.stale")
+	// attrLeaseDropped 加载期间key被更新或删除，租约失效，加载结果没有回填
+	attrLeaseDropped = attribute.Key("tcache.lease_dropped")
+	// attrFillError 加载成功但回填cache失败的原因
+	attrFillError = attribute.Key("tcache.fill_error")
+)
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
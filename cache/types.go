@@ -2,7 +2,8 @@ package cache
 
 import (
 	"errors"
-	"sync/atomic"
+	"fmt"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 )
@@ -15,32 +16,91 @@ const (
 	EngineLocalCache = "localcache"
 )
 
+// Capability cache实例支持的可选特性，不支持的特性调用时返回ErrNotSupported
+type Capability uint32
+
+// 可选特性定义
+const (
+	CapPerKeyTTL Capability = 1 << iota // SetWithExpire支持单独指定key的过期时间
+	CapResize                           // Resize支持运行时调整容量
+	CapBytesUsed                        // GetStats返回当前占用的字节数BytesUsed，不支持时为0
+)
+
+// Has 是否支持特性c
+func (c Capability) Has(x Capability) bool {
+	return c&x == x
+}
+
 // 错误码定义
 var (
-	ErrNotFound     = errors.New("not found")      // key不存在
-	ErrNoSuchEngine = errors.New("no such engine") // 没有该cache引擎
-	ErrNotSupported = errors.New("not supported")  // 不支持的特性
-	ErrCannotSet    = errors.New("cannot set")     // Get接口传入的值不支持赋值
+	ErrNotFound      = errors.New("not found")       // key不存在
+	ErrNoSuchEngine  = errors.New("no such engine")  // 没有该cache引擎
+	ErrNotSupported  = errors.New("not supported")   // 不支持的特性
+	ErrCannotSet     = errors.New("cannot set")      // Get接口传入的值不支持赋值
+	ErrInvalidConfig = errors.New("invalid config")  // 配置不合法
+	ErrClosed        = errors.New("cache closed")    // 实例已关闭
+	ErrResizing      = errors.New("resizing")        // 上一次调整容量还在迁移中
+	ErrValueTooLarge = errors.New("value too large") // value超过实例允许的最大大小
+	ErrValueMutated  = errors.New("value mutated")   // 开启MutationCheck时，发现value在Set之后被修改
+	ErrKeyTooLong    = errors.New("key too long")    // key超过KeyLengthMiddleware限制的长度
+	ErrCircuitOpen   = errors.New("circuit open")    // 自动加载熔断中，没有调用LoadFunc
+	ErrQueueFull     = errors.New("queue full")      // 异步写回Store的队列已满
+	ErrQuotaExceeded = errors.New("quota exceeded")  // 租户超出配额，见Partitioned
+	ErrDecode        = errors.New("decode failed")   // 读取时value解析失败，具体错误为*DecodeError
+	ErrLoadPanic     = errors.New("load panic")      // LoadFunc panic，已恢复并返回给所有等待的调用方
 )
 
-// Stats 统计数据
+// DecodeError 读取时保存的数据损坏无法解析，errors.Is(err, ErrDecode)为true。读取目标类型不匹配时返回ErrCannotSet，不返回DecodeError。
+// 引擎已删除无法解析的entry，GetWithLoad会重新加载；读取目标为*interface{}时不删除
+type DecodeError struct {
+	Engine string
+	Key    string
+	Err    error // 序列化实例或拷贝返回的错误
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: decode key %q: %v", e.Engine, e.Key, e.Err)
+}
+
+// Unwrap 返回解析失败的原始错误
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Is 使errors.Is(err, ErrDecode)成立
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// Stats 统计数据。计数类字段从实例创建或上次ResetStats开始累计，
+// 引擎无法提供的字段为0，各引擎填充的字段见README
 type Stats struct {
 	Hits    int64   `json:"hits"`       // 命中次数
 	Misses  int64   `json:"misses"`     // 未命中次数
 	HitRate float64 `json:"hit_rate"`   // 命中率,0~1
 	Loads   int64   `json:"auto_loads"` // 自动加载次数
-}
 
-func (s *Stats) atomicAddHitCount() {
-	atomic.AddInt64(&s.Hits, 1)
-}
+	EntryCount      int64 `json:"entry_count"`      // 当前保存的key数量
+	BytesUsed       int64 `json:"bytes_used"`       // 当前占用的字节数，仅支持CapBytesUsed的引擎提供
+	Evictions       int64 `json:"evictions"`        // 因容量不足被淘汰的key数量
+	Expirations     int64 `json:"expirations"`      // 过期被清理的key数量
+	Sets            int64 `json:"sets"`             // 写入成功次数
+	Deletes         int64 `json:"deletes"`          // 删除次数
+	LoadErrors      int64 `json:"load_errors"`      // 自动加载失败次数
+	SerializeErrors int64 `json:"serialize_errors"` // 序列化/反序列化失败次数
+	DecodeErrors    int64 `json:"decode_errors"`    // 读取时value解析失败次数，同时计入SerializeErrors
+	EarlyRefreshes  int64 `json:"early_refreshes"`  // 命中后按XFetch算法提前刷新的次数
+	StaleHits       int64 `json:"stale_hits"`       // 加载失败时返回过期数据的次数
+	LeaseDrops      int64 `json:"lease_drops"`      // 加载期间key被更新或删除，丢弃回填的次数
+	FillErrors      int64 `json:"fill_errors"`      // 加载成功但回填失败的次数，如value超过大小上限
+	EventDrops      int64 `json:"event_drops"`      // 引擎产生的事件因分发缓冲区已满被丢弃的次数，目前仅bigcache
 
-func (s *Stats) atomicAddMissCount() {
-	atomic.AddInt64(&s.Misses, 1)
-}
+	BreakerState string `json:"breaker_state,omitempty"` // 自动加载熔断器状态，未开启熔断时为空
+	BreakerOpens int64  `json:"breaker_opens"`           // 熔断器打开次数
 
-func (s *Stats) atomicAddLoadCount() {
-	atomic.AddInt64(&s.Loads, 1)
+	LoadDurationP50 time.Duration `json:"load_duration_p50"` // 自动加载耗时P50
+	LoadDurationP90 time.Duration `json:"load_duration_p90"` // 自动加载耗时P90
+	LoadDurationP99 time.Duration `json:"load_duration_p99"` // 自动加载耗时P99
 }
 
 func (s *Stats) calcHitRate() float64 {
@@ -51,11 +111,44 @@ func (s *Stats) calcHitRate() float64 {
 	return float64(s.Hits) / float64(total)
 }
 
+// WindowStats 最近一段时间窗口内的统计数据
+type WindowStats struct {
+	Window     time.Duration `json:"window"`      // 实际统计的时间窗口，按5秒向上取整
+	Hits       int64         `json:"hits"`        // 命中次数
+	Misses     int64         `json:"misses"`      // 未命中次数
+	HitRate    float64       `json:"hit_rate"`    // 命中率,0~1
+	Loads      int64         `json:"auto_loads"`  // 自动加载次数
+	LoadErrors int64         `json:"load_errors"` // 自动加载失败次数
+
+	LoadDurationP50 time.Duration `json:"load_duration_p50"` // 自动加载耗时P50
+	LoadDurationP90 time.Duration `json:"load_duration_p90"` // 自动加载耗时P90
+	LoadDurationP99 time.Duration `json:"load_duration_p99"` // 自动加载耗时P99
+}
+
 // Config 参数选项
 type Config struct {
+	Engine      string     // cache引擎名
 	MaxSizeInMB int        // cache占用的最大内存，单位MB
 	DefaultTTL  int64      // 未单独设置key过期时，默认过期时间，单位秒，0代表不限制
 	Serializer  Serializer // 序列化/反序列化实例
+	Compressor  Compressor // 压缩实例，为空代表不压缩
+	Sizer       Sizer      // value大小估算函数，仅localcache使用，为空时通过反射估算
+	CopyPolicy  CopyPolicy // value拷贝策略，仅localcache使用，默认不拷贝
+	// MutationCheck 调试用，仅localcache使用。Set时记录value序列化后的校验和，Get时校验，
+	// 不一致说明value在Set之后被修改，删除该key并返回ErrValueMutated
+	MutationCheck bool
+	TTLJitter     float64 // 过期时间随机浮动的比例，0~1，0代表不浮动
+	// EarlyRefreshBeta XFetch提前刷新系数，0代表不提前刷新，越大越早刷新
+	EarlyRefreshBeta float64
+	StaleTTL         int64         // 过期后继续保留的时间，单位秒，期间加载失败时返回过期数据，0代表不保留
+	BreakerFailures  int           // 自动加载连续失败多少次后熔断，0代表不熔断
+	BreakerCoolDown  time.Duration // 熔断后多久放行一次试探加载
+	LoadTimeout      time.Duration // GetWithLoad单次加载的超时时间，0代表不限制
+	// MaxConcurrentLoads 同时执行的LoadFunc数量上限(不同key)，0代表不限制
+	MaxConcurrentLoads int
+	// EventHook 引擎产生的变更事件回调：GetWithLoad回填(EventSet)、过期(EventExpire)、淘汰(EventEvict)，
+	// 一般为EventHub.Publish，为空代表不产生事件
+	EventHook func(Event)
 }
 
 // MaxSizeInBytes cache占用的最大内存，单位字节
@@ -67,12 +160,17 @@ func (c *Config) fixEmpty() {
 	if c.Serializer == nil {
 		c.Serializer = jsoniter.ConfigCompatibleWithStandardLibrary
 	}
-}
-
-// sizeToCapacity 初始化时指定的是缓存的大小。有些存储引擎使用的是key数量，因此按照一个key
-// 100字节来估算，将字节大小转化为key容量
-func (c *Config) sizeToCapacity() int {
-	return c.MaxSizeInBytes() / 100
+	if c.Sizer == nil {
+		c.Sizer = estimateSize
+	}
+	if c.Compressor != nil {
+		c.Serializer = &compressSerializer{Serializer: c.Serializer, compressor: c.Compressor}
+	}
+	if c.TTLJitter < 0 {
+		c.TTLJitter = 0
+	} else if c.TTLJitter > 1 {
+		c.TTLJitter = 1
+	}
 }
 
 // Option 设置参数选项
@@ -91,3 +189,87 @@ func WithSerializer(s Serializer) Option {
 		c.Serializer = s
 	}
 }
+
+// WithCompressor 指定压缩实例，value序列化后再压缩，仅对需要序列化的引擎生效
+func WithCompressor(c Compressor) Option {
+	return func(cfg *Config) {
+		cfg.Compressor = c
+	}
+}
+
+// WithSizer 指定value大小估算函数，localcache按估算的字节数限制内存并淘汰
+func WithSizer(sizer Sizer) Option {
+	return func(c *Config) {
+		c.Sizer = sizer
+	}
+}
+
+// WithCopyPolicy 指定localcache读写value时的拷贝策略
+func WithCopyPolicy(policy CopyPolicy) Option {
+	return func(c *Config) {
+		c.CopyPolicy = policy
+	}
+}
+
+// WithMutationCheck 开启localcache的value修改检测，有额外的序列化开销，仅用于调试
+func WithMutationCheck(enable bool) Option {
+	return func(c *Config) {
+		c.MutationCheck = enable
+	}
+}
+
+// WithTTLJitter 过期时间在[ttl*(1-fraction), ttl*(1+fraction)]内随机浮动，避免同时写入的大量key同时过期。
+// 对Set使用的默认过期时间、SetWithExpire和LoadFunc返回的过期时间均生效，
+// 不支持单key过期时间的引擎(bigcache)构造时返回ErrInvalidConfig
+func WithTTLJitter(fraction float64) Option {
+	return func(c *Config) {
+		c.TTLJitter = fraction
+	}
+}
+
+// WithEarlyRefresh 开启GetWithLoad的提前刷新(XFetch算法)：命中的key越接近过期、上次加载耗时越长，
+// 越可能由本次调用提前加载，避免热点key过期时大量请求同时回源。beta一般取1，越大越早刷新。
+// 不支持单key过期时间的引擎(bigcache)构造时返回ErrInvalidConfig
+func WithEarlyRefresh(beta float64) Option {
+	return func(c *Config) {
+		c.EarlyRefreshBeta = beta
+	}
+}
+
+// WithStaleIfError key过期后继续保留staleTTL秒，期间GetWithLoad的LoadFunc失败(含熔断)时返回过期的数据，
+// Get仍视为不存在。不支持单key过期时间的引擎(bigcache)构造时返回ErrInvalidConfig
+func WithStaleIfError(staleTTL int64) Option {
+	return func(c *Config) {
+		c.StaleTTL = staleTTL
+	}
+}
+
+// WithCircuitBreaker 开启自动加载熔断：LoadFunc连续失败failures次后，coolDown时间内不再调用，
+// GetWithLoad直接返回过期数据(开启WithStaleIfError时)或ErrCircuitOpen；冷却结束后放行一次试探调用
+func WithCircuitBreaker(failures int, coolDown time.Duration) Option {
+	return func(c *Config) {
+		c.BreakerFailures, c.BreakerCoolDown = failures, coolDown
+	}
+}
+
+// WithLoadTimeout 设置GetWithLoad单次加载的超时时间。加载在独立的ctx中执行，不会因为某个调用方的ctx取消而中断，
+// 只受timeout限制，超时后LoadFunc收到的ctx被取消
+func WithLoadTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.LoadTimeout = timeout
+	}
+}
+
+// WithEventHook 设置引擎变更事件回调，一般为EventHub.Publish，见EventHub
+func WithEventHook(hook func(Event)) Option {
+	return func(c *Config) {
+		c.EventHook = hook
+	}
+}
+
+// WithMaxConcurrentLoads 限制同时执行的LoadFunc数量，超出时排队等待，排队时间计入WithLoadTimeout
+func WithMaxConcurrentLoads(n int) Option {
+	return func(c *Config) {
+		c.MaxConcurrentLoads = n
+	}
+}
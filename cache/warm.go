@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WarmProgress 预热进度
+type WarmProgress struct {
+	Total  int64 // 需要预热的key数量，从io.Reader读取时为已读取的数量
+	Loaded int64 // 预热成功的key数量，包括已在cache中的key
+	Failed int64 // 预热失败的key数量
+}
+
+// WarmStatus 预热状态，可以在预热进行中查询进度，或在就绪检查中等待预热完成
+type WarmStatus struct {
+	total, loaded, failed int64 // 原子读写
+	done                  chan struct{}
+	once                  sync.Once
+	err                   error
+}
+
+// NewWarmStatus 构造预热状态，通过WithWarmStatus传给Warm
+func NewWarmStatus() *WarmStatus {
+	return &WarmStatus{done: make(chan struct{})}
+}
+
+// Progress 当前进度
+func (s *WarmStatus) Progress() WarmProgress {
+	return WarmProgress{
+		Total:  atomic.LoadInt64(&s.total),
+		Loaded: atomic.LoadInt64(&s.loaded),
+		Failed: atomic.LoadInt64(&s.failed),
+	}
+}
+
+// Ready 预热是否已结束
+func (s *WarmStatus) Ready() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait 等待预热结束，返回Warm的错误；ctx先结束时返回ctx.Err()
+func (s *WarmStatus) Wait(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *WarmStatus) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// warmConfig 预热参数
+type warmConfig struct {
+	value    interface{}
+	rate     float64
+	status   *WarmStatus
+	progress func(WarmProgress)
+	onError  func(key string, err error)
+}
+
+// WarmOption 预热参数选项
+type WarmOption func(*warmConfig)
+
+// WithWarmValue 指定LoadFunc接收value的类型，每个key使用value同类型的新对象，默认为*interface{}
+func WithWarmValue(value interface{}) WarmOption {
+	return func(c *warmConfig) {
+		c.value = value
+	}
+}
+
+// WithWarmRateLimit 限制每秒最多预热perSecond个key，0或超过1e9代表不限制
+func WithWarmRateLimit(perSecond float64) WarmOption {
+	return func(c *warmConfig) {
+		c.rate = perSecond
+	}
+}
+
+// WithWarmStatus 通过status查询进度和等待预热结束
+func WithWarmStatus(status *WarmStatus) WarmOption {
+	return func(c *warmConfig) {
+		c.status = status
+	}
+}
+
+// WithWarmProgress 每个key预热完成后回调当前进度，可能并发调用
+func WithWarmProgress(progress func(WarmProgress)) WarmOption {
+	return func(c *warmConfig) {
+		c.progress = progress
+	}
+}
+
+// WithWarmOnError 每个key预热失败时回调，可能并发调用
+func WithWarmOnError(onError func(key string, err error)) WarmOption {
+	return func(c *warmConfig) {
+		c.onError = onError
+	}
+}
+
+// Warm 预热cache实例：以concurrency个协程通过GetWithLoad加载keys，已在cache中的key不重复加载。
+// 单个key失败不中断预热，计入WarmProgress.Failed；ctx结束时停止并返回ctx.Err()
+func Warm(ctx context.Context, api API, keys []string, load LoadFunc, concurrency int,
+	opts ...WarmOption) (WarmProgress, error) {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for _, key := range keys {
+			select {
+			case ch <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return warm(ctx, api, ch, nil, load, concurrency, int64(len(keys)), opts)
+}
+
+// WarmFromReader 同Warm，从r中按行读取key，忽略空行，适用于key数量很多的场景
+func WarmFromReader(ctx context.Context, api API, r io.Reader, load LoadFunc, concurrency int,
+	opts ...WarmOption) (WarmProgress, error) {
+	ch := make(chan string)
+	var readErr error
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			key := strings.TrimSpace(scanner.Text())
+			if key == "" {
+				continue
+			}
+			select {
+			case ch <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+		readErr = scanner.Err()
+	}()
+	return warm(ctx, api, ch, &readErr, load, concurrency, -1, opts)
+}
+
+// warm 消费keys直到关闭，total<0代表总数未知，按读取数累计。readErr在keys关闭后读取
+func warm(ctx context.Context, api API, keys <-chan string, readErr *error, load LoadFunc, concurrency int,
+	total int64, opts []WarmOption) (WarmProgress, error) {
+	cfg := &warmConfig{value: new(interface{})}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	status := cfg.status
+	if status == nil {
+		status = NewWarmStatus()
+	}
+	if total >= 0 {
+		atomic.StoreInt64(&status.total, total)
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var tick <-chan time.Time
+	// 每秒超过1e9个时间隔不足1纳秒，视为不限速
+	if interval := time.Duration(float64(time.Second) / cfg.rate); cfg.rate > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if total < 0 {
+					atomic.AddInt64(&status.total, 1)
+				}
+				if tick != nil {
+					select {
+					case <-tick:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					continue // 继续消费keys，直到生产者退出
+				}
+				if err := api.GetWithLoad(ctx, key, newValue(cfg.value), load); err != nil {
+					atomic.AddInt64(&status.failed, 1)
+					if cfg.onError != nil {
+						cfg.onError(key, err)
+					}
+				} else {
+					atomic.AddInt64(&status.loaded, 1)
+				}
+				if cfg.progress != nil {
+					cfg.progress(status.Progress())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := ctx.Err()
+	if err == nil && readErr != nil {
+		err = *readErr
+	}
+	status.finish(err)
+	return status.Progress(), err
+}
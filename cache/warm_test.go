@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarm(t *testing.T) {
+	cache, err := New(EngineFreeCache, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Set("a", 0))
+	var loads int32
+	load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		atomic.AddInt32(&loads, 1)
+		if key == "bad" {
+			return 0, errors.New("db down")
+		}
+		*value.(*int) = len(key)
+		return 0, nil
+	}
+
+	status := NewWarmStatus()
+	assert.False(t, status.Ready())
+	var failed []string
+	var reports int32
+	progress, err := Warm(context.Background(), cache, []string{"a", "bb", "ccc", "bad"}, load, 2,
+		WithWarmValue(new(int)), WithWarmStatus(status),
+		WithWarmOnError(func(key string, err error) { failed = append(failed, key) }),
+		WithWarmProgress(func(WarmProgress) { atomic.AddInt32(&reports, 1) }))
+	assert.Nil(t, err)
+	assert.Equal(t, WarmProgress{Total: 4, Loaded: 3, Failed: 1}, progress)
+	assert.Equal(t, []string{"bad"}, failed)
+	assert.Equal(t, int32(4), reports)
+	assert.Equal(t, int32(3), loads) // a已在cache中
+	assert.True(t, status.Ready())
+	assert.Nil(t, status.Wait(context.Background()))
+	var value int
+	assert.Nil(t, cache.Get("ccc", &value))
+	assert.Equal(t, 3, value)
+
+	// 从io.Reader读取，限速
+	start := time.Now()
+	progress, err = WarmFromReader(context.Background(), cache, strings.NewReader("d\n\nee\nfff\n"), load, 4,
+		WithWarmValue(new(int)), WithWarmRateLimit(50))
+	assert.Nil(t, err)
+	assert.Equal(t, WarmProgress{Total: 3, Loaded: 3}, progress)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// 超过每秒1e9个视为不限速
+	progress, err = Warm(context.Background(), cache, []string{"g"}, load, 1, WithWarmValue(new(int)),
+		WithWarmRateLimit(1e10))
+	assert.Nil(t, err)
+	assert.Equal(t, WarmProgress{Total: 1, Loaded: 1}, progress)
+
+	// ctx取消时停止
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Warm(ctx, cache, []string{"x", "y"}, load, 1, WithWarmValue(new(int)))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, ErrNotFound, cache.Get("x", &value))
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultWatchBuffer = 1024
+
+// 变更事件类型
+const (
+	EventSet    = "set"    // 写入，包括GetWithLoad回填
+	EventDelete = "delete" // 删除
+	EventExpire = "expire" // 过期被清理
+	EventEvict  = "evict"  // 因容量不足被淘汰
+	EventClear  = "clear"  // 清空实例，Key为空
+)
+
+// Event cache变更事件
+type Event struct {
+	Type string // 事件类型，EventSet等
+	Key  string
+	TTL  int64 // 仅EventSet有效，单位秒，Set未指定过期时间或不过期时为0，GetWithLoad回填时为浮动后实际写入的过期时间
+}
+
+// WatchPolicy 订阅者的缓冲区满时的处理方式
+type WatchPolicy int
+
+// 缓冲区满时的处理方式
+const (
+	WatchDrop  WatchPolicy = iota // 丢弃事件，不影响cache写入，丢弃数见EventHub.Dropped
+	WatchBlock                    // 阻塞写入方直到订阅者读取或取消订阅
+)
+
+// EventHubConfig 事件分发配置
+type EventHubConfig struct {
+	Buffer int         // 每个订阅者的缓冲区大小，默认1024
+	Policy WatchPolicy // 缓冲区满时的处理方式，默认WatchDrop
+}
+
+// EventHub 分发cache实例的变更事件。Set/Delete/Clear事件来自Middleware，
+// 回填、过期和淘汰事件来自引擎，通过WithEventHook(hub.Publish)接入：
+//
+//	hub := cache.NewEventHub(cache.EventHubConfig{})
+//	api, err := cache.New(cache.EngineLocalCache, 100, cache.WithEventHook(hub.Publish))
+//	api = cache.Chain(api, hub.Middleware())
+//	events := hub.Watch(ctx, "user_")
+type EventHub struct {
+	cfg     EventHubConfig
+	lock    sync.RWMutex
+	subs    map[*watcher]struct{}
+	dropped int64 // 原子读写
+}
+
+// watcher 一个订阅者
+type watcher struct {
+	prefix string
+	ch     chan Event
+	done   <-chan struct{}
+}
+
+// NewEventHub 构造事件分发
+func NewEventHub(cfg EventHubConfig) *EventHub {
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = defaultWatchBuffer
+	}
+	return &EventHub{cfg: cfg, subs: make(map[*watcher]struct{})}
+}
+
+// Watch 订阅key以prefix开头的变更事件，Clear事件总是收到。ctx结束时取消订阅并关闭返回的channel
+func (h *EventHub) Watch(ctx context.Context, prefix string) <-chan Event {
+	w := &watcher{prefix: prefix, ch: make(chan Event, h.cfg.Buffer), done: ctx.Done()}
+	h.lock.Lock()
+	h.subs[w] = struct{}{}
+	h.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.lock.Lock()
+		delete(h.subs, w)
+		h.lock.Unlock()
+		close(w.ch)
+	}()
+	return w.ch
+}
+
+// Publish 分发事件，可作为WithEventHook的参数。WatchBlock时阻塞到所有匹配的订阅者接收或取消订阅，
+// 引擎的过期、淘汰回调可能持有引擎内部的锁，订阅者处理事件时不能再调用同一个实例
+func (h *EventHub) Publish(ev Event) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for w := range h.subs {
+		if ev.Type != EventClear && !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		if h.cfg.Policy == WatchBlock {
+			select {
+			case w.ch <- ev:
+			case <-w.done:
+			}
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			atomic.AddInt64(&h.dropped, 1)
+		}
+	}
+}
+
+// Dropped 因缓冲区满丢弃的事件数
+func (h *EventHub) Dropped() int64 {
+	return atomic.LoadInt64(&h.dropped)
+}
+
+// Middleware 返回产生Set/Delete/Clear事件的中间件，操作成功后分发事件
+func (h *EventHub) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, op *Operation) error {
+			err := next(ctx, op)
+			if err != nil {
+				return err
+			}
+			switch op.Name {
+			case OpSet:
+				h.Publish(Event{Type: EventSet, Key: op.Key})
+			case OpSetWithExpire:
+				h.Publish(Event{Type: EventSet, Key: op.Key, TTL: op.TTL})
+			case OpDelete:
+				h.Publish(Event{Type: EventDelete, Key: op.Key})
+			case OpClear:
+				h.Publish(Event{Type: EventClear})
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	hub := NewEventHub(EventHubConfig{Buffer: 10})
+	api, err := New(EngineLocalCache, 1, WithEventHook(hub.Publish))
+	assert.Nil(t, err)
+	cache := Chain(api, hub.Middleware())
+	ctx, cancel := context.WithCancel(context.Background())
+	events := hub.Watch(ctx, "u_")
+
+	assert.Nil(t, cache.Set("u_1", 1))
+	assert.Nil(t, cache.Set("x_1", 1)) // 前缀不匹配
+	assert.Nil(t, cache.SetWithExpire("u_2", 2, 60))
+	assert.Nil(t, testLoad(cache, "u_3"))
+	assert.Nil(t, cache.Delete("u_1"))
+	assert.Nil(t, cache.Clear())
+	// 超出内存限制淘汰
+	big := strings.Repeat("a", 600*1024)
+	assert.Nil(t, cache.Set("u_4", big))
+	assert.Nil(t, cache.Set("u_5", big))
+
+	var got []Event
+	for i := 0; i < 8; i++ {
+		got = append(got, <-events)
+	}
+	assert.Equal(t, []Event{
+		{Type: EventSet, Key: "u_1"},
+		{Type: EventSet, Key: "u_2", TTL: 60},
+		{Type: EventSet, Key: "u_3"},
+		{Type: EventDelete, Key: "u_1"},
+		{Type: EventClear},
+		{Type: EventSet, Key: "u_4"},
+		{Type: EventEvict, Key: "u_4"},
+		{Type: EventSet, Key: "u_5"},
+	}, got)
+
+	// 取消订阅后关闭channel
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// 缓冲区满时丢弃
+	hub = NewEventHub(EventHubConfig{Buffer: 1})
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events = hub.Watch(ctx, "")
+	hub.Publish(Event{Type: EventDelete, Key: "a"})
+	hub.Publish(Event{Type: EventDelete, Key: "b"})
+	assert.Equal(t, int64(1), hub.Dropped())
+	assert.Equal(t, "a", (<-events).Key)
+
+	// 阻塞直到订阅者读取
+	hub = NewEventHub(EventHubConfig{Buffer: 1, Policy: WatchBlock})
+	events = hub.Watch(ctx, "")
+	hub.Publish(Event{Type: EventDelete, Key: "a"})
+	published := make(chan struct{})
+	go func() {
+		hub.Publish(Event{Type: EventDelete, Key: "b"})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publish should block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, "a", (<-events).Key)
+	<-published
+	assert.Equal(t, "b", (<-events).Key)
+	assert.Equal(t, int64(0), hub.Dropped())
+}
+
+func TestWatchBigCacheEvict(t *testing.T) {
+	// bigcache在分片锁中产生淘汰事件，WatchBlock的订阅者调用同一实例不能死锁
+	hub := NewEventHub(EventHubConfig{Buffer: 1, Policy: WatchBlock})
+	api, err := New(EngineBigCache, 1, WithEventHook(hub.Publish))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := hub.Watch(ctx, "")
+	evicted := make(chan struct{})
+	go func() {
+		<-events
+		time.Sleep(20 * time.Millisecond) // 等待写入方在分片锁中阻塞
+		assert.Nil(t, api.Clear())
+		close(evicted)
+		cancel()
+	}()
+
+	limit, _ := MaxValueSize(api, "0")
+	big := strings.Repeat("a", limit/2)
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, api.Set(fmt.Sprint(i), big))
+	}
+	select {
+	case <-evicted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no evict event")
+	}
+	assert.Nil(t, CloseInstance(api))
+}
+
+func TestWatchBigCacheDrop(t *testing.T) {
+	// 订阅者处理慢时缓冲区满，丢弃事件而不阻塞写入
+	release := make(chan struct{})
+	api, err := New(EngineBigCache, 1, WithEventHook(func(Event) { <-release }))
+	assert.Nil(t, err)
+	limit, _ := MaxValueSize(api, "0")
+	big := strings.Repeat("a", limit/2)
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, api.Set(fmt.Sprint(i), big))
+	}
+	assert.Greater(t, api.GetStats().EventDrops, int64(0))
+	close(release)
+	assert.Nil(t, CloseInstance(api))
+}
+
+func TestWatchFillTTL(t *testing.T) {
+	defer func(f func() float64) { jitterRand = f }(jitterRand)
+	jitterRand = func() float64 { return 1 }
+	load := func(ctx context.Context, key string, value interface{}) (int64, error) {
+		*value.(*int) = 1
+		return 30, nil
+	}
+	var value int
+	// 事件中为浮动后实际写入的过期时间
+	var got []Event
+	api, err := New(EngineLocalCache, 1, WithTTLJitter(0.5), WithEventHook(func(e Event) { got = append(got, e) }))
+	assert.Nil(t, err)
+	assert.Nil(t, api.GetWithLoad(context.Background(), "a", &value, load))
+	assert.Equal(t, []Event{{Type: EventSet, Key: "a", TTL: 45}}, got)
+
+	// bigcache不支持单key过期时间，按DefaultTTL过期
+	var mu sync.Mutex
+	got = nil
+	api, err = New(EngineBigCache, 1, WithDefaultTTL(60), WithEventHook(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e)
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, api.GetWithLoad(context.Background(), "a", &value, load))
+	assert.Nil(t, CloseInstance(api))
+	assert.Equal(t, []Event{{Type: EventSet, Key: "a", TTL: 60}}, got)
+}
@@ -0,0 +1,157 @@
+// Package metrics 将命名cache实例、命名bitmap实例和redis bitmap操作耗时导出为prometheus指标，
+// 按需引入：
+//
+//	if err := metrics.Register(prometheus.DefaultRegisterer); err != nil {
+//	    log.Fatal(err)
+//	}
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/bitmap"
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/bitmap/roaring"
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "tcache"
+
+var (
+	cacheLabels = []string{"instance", "engine"}
+
+	hitsDesc        = newCacheDesc("hits_total", "Number of cache hits.")
+	missesDesc      = newCacheDesc("misses_total", "Number of cache misses.")
+	loadsDesc       = newCacheDesc("loads_total", "Number of LoadFunc calls.")
+	loadErrorsDesc  = newCacheDesc("load_errors_total", "Number of failed LoadFunc calls.")
+	evictionsDesc   = newCacheDesc("evictions_total", "Number of entries evicted for lack of space.")
+	expirationsDesc = newCacheDesc("expirations_total", "Number of expired entries.")
+	refreshesDesc   = newCacheDesc("early_refreshes_total", "Number of hits recomputed early by XFetch.")
+	staleHitsDesc   = newCacheDesc("stale_hits_total", "Number of stale entries served after load failures.")
+	breakerDesc     = newCacheDesc("breaker_opens_total", "Number of times the load circuit breaker opened.")
+	leaseDropsDesc  = newCacheDesc("lease_drops_total", "Number of loaded values dropped because the key changed during the load.")
+	decodeErrsDesc  = newCacheDesc("decode_errors_total", "Number of stored values that failed to decode on read.")
+	entriesDesc     = newCacheDesc("entries", "Number of entries currently stored.")
+	bytesDesc       = newCacheDesc("bytes_used", "Bytes currently used.")
+	loadDesc        = newCacheDesc("load_duration_seconds", "Duration of LoadFunc calls.")
+
+	bitmapCardinalityDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "bitmap", "cardinality"),
+		"Number of integers stored in the bitmap.", []string{"instance"}, nil)
+
+	roaringOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "roaring",
+		Name:      "op_duration_seconds",
+		Help:      "Duration of redis roaring bitmap operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"instance", "op", "result"})
+
+	observeOnce sync.Once
+)
+
+func newCacheDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, cacheLabels, nil)
+}
+
+// Register 向reg注册cache和bitmap的采集器，以及redis bitmap操作耗时直方图
+func Register(reg prometheus.Registerer) error {
+	if err := reg.Register(NewCollector()); err != nil {
+		return err
+	}
+	if err := reg.Register(roaringOpDuration); err != nil {
+		return err
+	}
+	observeOnce.Do(func() {
+		roaring.AddOpObserver(observeRoaringOp)
+	})
+	return nil
+}
+
+func observeRoaringOp(name string, op string, cost time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	roaringOpDuration.WithLabelValues(name, op, result).Observe(cost.Seconds())
+}
+
+// Collector 每次采集时遍历所有命名cache实例和命名bitmap实例
+type Collector struct{}
+
+// NewCollector 构造采集器
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// Describe 实现prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{hitsDesc, missesDesc, loadsDesc, loadErrorsDesc, evictionsDesc,
+		expirationsDesc, refreshesDesc, staleHitsDesc, breakerDesc, leaseDropsDesc, decodeErrsDesc, entriesDesc, bytesDesc, loadDesc,
+		bitmapCardinalityDesc} {
+		ch <- desc
+	}
+}
+
+// Collect 实现prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range cache.InstanceNames() {
+		c.collectCache(ch, name)
+	}
+	for _, name := range bitmap.InstanceNames() {
+		if b := bitmap.GetInstance(name); b != nil {
+			ch <- prometheus.MustNewConstMetric(bitmapCardinalityDesc, prometheus.GaugeValue, float64(b.Len()), name)
+		}
+	}
+}
+
+func (c *Collector) collectCache(ch chan<- prometheus.Metric, name string) {
+	api := cache.GetInstance(name)
+	if api == nil {
+		return
+	}
+	// RegisterInstance注册的实例没有配置，取实例自身的引擎名
+	engine := cache.GetInstanceEngine(api)
+	if cfg := cache.GetInstanceConfig(name); engine == "" && cfg != nil {
+		engine = cfg.Engine
+	}
+	stats := api.GetStats()
+	for _, m := range []struct {
+		desc      *prometheus.Desc
+		valueType prometheus.ValueType
+		value     int64
+	}{
+		{hitsDesc, prometheus.CounterValue, stats.Hits},
+		{missesDesc, prometheus.CounterValue, stats.Misses},
+		{loadsDesc, prometheus.CounterValue, stats.Loads},
+		{loadErrorsDesc, prometheus.CounterValue, stats.LoadErrors},
+		{evictionsDesc, prometheus.CounterValue, stats.Evictions},
+		{expirationsDesc, prometheus.CounterValue, stats.Expirations},
+		{refreshesDesc, prometheus.CounterValue, stats.EarlyRefreshes},
+		{staleHitsDesc, prometheus.CounterValue, stats.StaleHits},
+		{breakerDesc, prometheus.CounterValue, stats.BreakerOpens},
+		{leaseDropsDesc, prometheus.CounterValue, stats.LeaseDrops},
+		{decodeErrsDesc, prometheus.CounterValue, stats.DecodeErrors},
+		{entriesDesc, prometheus.GaugeValue, stats.EntryCount},
+	} {
+		ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, float64(m.value), name, engine)
+	}
+	// 不提供占用字节数的引擎不导出，避免0被误认为没有占用
+	if cache.GetInstanceCapabilities(api).Has(cache.CapBytesUsed) {
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.GaugeValue, float64(stats.BytesUsed), name, engine)
+	}
+	if h, ok := api.(cache.LoadHistogram); ok {
+		ch <- loadHistogram(h.LoadDurationHistogram(), name, engine)
+	}
+}
+
+// loadHistogram 将cache的耗时直方图转换为prometheus的累计直方图
+func loadHistogram(h cache.HistogramSnapshot, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.UpperBounds))
+	var count uint64
+	for i, bound := range h.UpperBounds {
+		count += uint64(h.Counts[i])
+		buckets[bound.Seconds()] = count
+	}
+	return prometheus.MustNewConstHistogram(loadDesc, count, h.Sum.Seconds(), buckets, labels...)
+}
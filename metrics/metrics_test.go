@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/bitmap"
+	"git.code.oa.com/video_pay_root/pay-go-comm/tcache/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	err := cache.SetupInstances([]*cache.InstanceConfig{
+		{Name: "metrics_test", Engine: cache.EngineFreeCache, MaxSizeInMB: 1},
+	})
+	assert.Nil(t, err)
+	c := cache.GetInstance("metrics_test")
+	defer cache.CloseInstance(c)
+
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get("a", &value))
+	assert.Nil(t, c.GetWithLoad(context.Background(), "a", &value, func(ctx context.Context, key string,
+		value interface{}) (int64, error) {
+		*value.(*string) = "1"
+		return 0, nil
+	}))
+	assert.Nil(t, c.Get("a", &value))
+
+	b, err := bitmap.New(bitmap.EngineBitset)
+	assert.Nil(t, err)
+	b.Add(1)
+	b.Add(2)
+	bitmap.RegisterInstance("metrics_test", b)
+
+	collector := NewCollector()
+	expected := `
+# HELP tcache_cache_hits_total Number of cache hits.
+# TYPE tcache_cache_hits_total counter
+tcache_cache_hits_total{engine="freecache",instance="metrics_test"} 1
+# HELP tcache_cache_misses_total Number of cache misses.
+# TYPE tcache_cache_misses_total counter
+tcache_cache_misses_total{engine="freecache",instance="metrics_test"} 2
+# HELP tcache_cache_loads_total Number of LoadFunc calls.
+# TYPE tcache_cache_loads_total counter
+tcache_cache_loads_total{engine="freecache",instance="metrics_test"} 1
+# HELP tcache_cache_entries Number of entries currently stored.
+# TYPE tcache_cache_entries gauge
+tcache_cache_entries{engine="freecache",instance="metrics_test"} 1
+# HELP tcache_bitmap_cardinality Number of integers stored in the bitmap.
+# TYPE tcache_bitmap_cardinality gauge
+tcache_bitmap_cardinality{instance="metrics_test"} 2
+`
+	assert.Nil(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"tcache_cache_hits_total", "tcache_cache_misses_total", "tcache_cache_loads_total",
+		"tcache_cache_entries", "tcache_bitmap_cardinality"))
+
+	// 每个cache实例12个指标(freecache不导出bytes_used)，每个bitmap实例1个指标
+	assert.Equal(t, 14, testutil.CollectAndCount(collector))
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "tcache_cache_load_duration_seconds"))
+}
+
+func TestCollectorEngine(t *testing.T) {
+	// 未通过配置创建的实例，engine标签取实例自身的引擎名
+	api, err := cache.New(cache.EngineLocalCache, 1)
+	assert.Nil(t, err)
+	cache.RegisterInstance("metrics_engine_test", cache.Chain(api, cache.LoggingMiddleware()))
+	defer cache.CloseInstance(api)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewCollector())
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	labels := map[string]string{}
+	for _, family := range families {
+		if family.GetName() != "tcache_cache_entries" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			var instance, engine string
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "instance":
+					instance = l.GetValue()
+				case "engine":
+					engine = l.GetValue()
+				}
+			}
+			labels[instance] = engine
+		}
+	}
+	assert.Equal(t, "localcache", labels["metrics_engine_test"])
+	count, err := testutil.GatherAndCount(reg, "tcache_cache_bytes_used")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count) // 只有localcache实例导出
+}
+
+func TestRegister(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	assert.Nil(t, Register(reg))
+	assert.NotNil(t, Register(reg)) // 重复注册
+
+	observeRoaringOp("uv", "radd", time.Millisecond, nil)
+	observeRoaringOp("uv", "radd", time.Millisecond, nil)
+	observeRoaringOp("uv", "rcard", time.Millisecond, errors.New("timeout"))
+	assert.Equal(t, 2, testutil.CollectAndCount(roaringOpDuration))
+	count, err := testutil.GatherAndCount(reg, "tcache_roaring_op_duration_seconds")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+}